@@ -2,17 +2,16 @@ package main
 
 import (
 	"bytes"
-	"compress/zlib"
-	"encoding/ascii85"
 	"flag"
 	"fmt"
 	"github.com/bnagy/pdflex"
-	"io"
+	"github.com/bnagy/pdflex/filters"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 )
@@ -20,148 +19,274 @@ import (
 var xref = []byte("xref")
 var startxref = []byte("startxref")
 var trailer = []byte("trailer")
-var pref85 = "<~"
-var suff85 = "~>"
 
 var (
-	flagStrict  = flag.Bool("strict", false, "Abort on xref parsing errors etc")
-	flagMax     = flag.Int("max", 128, "Trim streams whose size is greater than this value")
-	flagWorkers = flag.Int("workers", 1, "Number of concurrent workers to use")
+	flagStrict   = flag.Bool("strict", false, "Abort on xref parsing errors etc")
+	flagMax      = flag.Int("max", 128, "Trim streams whose size is greater than this value")
+	flagWorkers  = flag.Int("workers", 1, "Number of concurrent workers to use")
+	flagRepair   = flag.Bool("repair", false, "Rebuild the xref from scratch instead of fixing it")
+	flagBadLen   = flag.Bool("badlength", false, "Leave /Length as it was for shrunk streams, so it is wrong")
+	flagRaw      = flag.Bool("raw", false, "Truncate streams that can't be decoded without decoding them")
+	flagPassword = flag.String("password", "", "User or owner password for encrypted files, if the user password isn't empty")
 )
 
-func inflate(s string) (string, error) {
-	in := strings.NewReader(s)
-	decom, err := zlib.NewReader(in)
-	if err != nil {
-		return "", err
-	}
-
-	var b bytes.Buffer
-	_, err = io.Copy(&b, decom)
-	decom.Close()
-
-	return b.String(), err
+// streamLength tracks the /Length of the stream dict being written, so it
+// can be rewritten once the new body is known.
+type streamLength struct {
+	state  int    // 0 nothing, 1 seen /Length, 2 seen N, 3 seen N G
+	at     int    // where N was written to the output
+	val    string // N as written
+	direct bool   // N is the length
+	ref    [2]int // or it's N G R
+	isRef  bool
 }
 
-func deflate(s string) (string, error) {
-	var b bytes.Buffer
-	w := zlib.NewWriter(&b)
-	_, err := w.Write([]byte(s))
-	w.Close()
-	if err != nil {
-		return "", err
+// see updates the state with one significant item, which will be written to
+// the output at pos. depth is the dict nesting depth of the item.
+func (sl *streamLength) see(i pdflex.Item, pos, depth int) {
+	switch {
+	case i.Typ == pdflex.ItemName && i.Val == "/Length" && depth == 1:
+		*sl = streamLength{state: 1}
+	case sl.state == 1 && i.Typ == pdflex.ItemNumber:
+		sl.state, sl.at, sl.val, sl.direct = 2, pos, i.Val, true
+	case sl.state == 2 && i.Typ == pdflex.ItemNumber:
+		n, err1 := strconv.Atoi(sl.val)
+		g, err2 := strconv.Atoi(i.Val)
+		sl.state = 0
+		if err1 == nil && err2 == nil {
+			sl.state, sl.ref = 3, [2]int{n, g}
+		}
+	case sl.state == 3 && i.Typ == pdflex.ItemWord && i.Val == "R":
+		sl.state, sl.direct, sl.isRef = 0, false, true
+	default:
+		sl.state = 0
 	}
+}
 
-	return b.String(), nil
+// setLength replaces the direct /Length that sl found in out with n.
+func (sl *streamLength) setLength(out *bytes.Buffer, n int) {
+	b := out.Bytes()
+	rest := append([]byte(nil), b[sl.at+len(sl.val):]...)
+	out.Truncate(sl.at)
+	out.WriteString(strconv.Itoa(n))
+	out.Write(rest)
 }
 
-func un85(s string) (string, error) {
-	// Caller is expected to trim <~ ~> if present
-	s = strings.TrimPrefix(s, pref85)
-	s = strings.TrimSuffix(s, suff85)
-	dec := ascii85.NewDecoder(strings.NewReader(s))
-	out, err := ioutil.ReadAll(dec)
+// setIndirectLengths rewrites the value of every N G obj in lengths, which
+// are the indirect /Length objects of shrunk streams.
+func setIndirectLengths(in []byte, lengths map[[2]int]int) []byte {
+	l := pdflex.NewLexer("", string(in))
+	var out bytes.Buffer
+	var sig [3]pdflex.Item // the last three significant items
+	for i := l.Next(); i.Typ != pdflex.ItemEOF; i = l.Next() {
+		val := i.Val
+		if i.Typ == pdflex.ItemNumber && sig[2].Typ == pdflex.ItemObj &&
+			sig[0].Typ == pdflex.ItemNumber && sig[1].Typ == pdflex.ItemNumber {
+			n, _ := strconv.Atoi(sig[0].Val)
+			g, _ := strconv.Atoi(sig[1].Val)
+			if length, ok := lengths[[2]int{n, g}]; ok {
+				val = strconv.Itoa(length)
+			}
+		}
+		out.WriteString(val)
+		switch i.Typ {
+		case pdflex.ItemSpace, pdflex.ItemEOL, pdflex.ItemComment:
+		case pdflex.ItemError:
+			return out.Bytes()
+		default:
+			sig[0], sig[1], sig[2] = sig[1], sig[2], i
+		}
+	}
+	return out.Bytes()
+}
 
+// shrinkBody returns the new body for a stream with dict d, which is in object
+// num gen, or false if it should be left alone. The body is decrypted if c
+// isn't nil, decoded with the stream's own filter chain, cut to at most max
+// bytes (on a row boundary if there's a predictor), then encoded and
+// encrypted again. Bodies that are damaged part way through, like truncated
+// Flate data, are cut from what could be decoded, unless -strict. Bodies that
+// can't be decoded at all are only truncated as they are with -raw.
+func shrinkBody(c *pdflex.Crypt, num, gen int, d pdflex.Dict, raw string, max int) (string, bool, error) {
+	if t, ok := d.Get("Type").(pdflex.Name); ok && (t.Value == "XRef" || t.Value == "ObjStm") {
+		// xref and object streams can't be truncated
+		return "", false, nil
+	}
+	s := pdflex.Stream{Dict: d, Raw: []byte(raw)}
+	seal := func(b []byte) ([]byte, error) { return b, nil }
+	var err error
+	if c != nil {
+		var o pdflex.Object
+		if o, err = c.Decrypt(num, gen, s); err == nil {
+			s = o.(pdflex.Stream)
+			seal = func(b []byte) ([]byte, error) {
+				o, err := c.Encrypt(num, gen, pdflex.Stream{Dict: d, Raw: b})
+				if err != nil {
+					return nil, err
+				}
+				return o.(pdflex.Stream).Raw, nil
+			}
+		}
+	}
+	var chain []filters.Filter
+	var data []byte
+	if err == nil {
+		chain, err = s.Filters()
+	}
+	if err == nil {
+		if data, err = filters.Decode(s.Raw, chain); data != nil && !*flagStrict {
+			err = nil
+		}
+	}
 	if err != nil {
-		return "", err
+		if *flagStrict {
+			return "", false, fmt.Errorf("can't decode stream in object %d %d: %s", num, gen, err)
+		}
+		if !*flagRaw || len(s.Raw) <= max {
+			return "", false, nil
+		}
+		// truncate the decrypted, but still encoded, body
+		chain, data = nil, s.Raw
 	}
 
-	return string(out), nil
+	n := max
+	if len(chain) > 0 {
+		row := filters.RowLen(chain[len(chain)-1].Params)
+		if n -= n % row; n == 0 {
+			n = row
+		}
+	}
+	if len(data) <= n {
+		return "", false, nil
+	}
+	enc, err := filters.Encode(data[:n], chain)
+	if err == nil {
+		enc, err = seal(enc)
+	}
+	if err != nil {
+		// should never happen, strict mode or not
+		return "", false, fmt.Errorf("error encoding truncated stream: %s", err)
+	}
+	return string(enc), true, nil
 }
 
-func re85(s string) (string, error) {
-	var b bytes.Buffer
-	w := ascii85.NewEncoder(&b)
-	_, err := w.Write([]byte(s))
-	w.Close()
+// unlock returns the Crypt for an encrypted input, using -password if it was
+// given, or nil if the input isn't encrypted. Inputs that are too broken to
+// open are repaired in memory first, just to find the /Encrypt dict. If even
+// that fails there's no telling whether the input is encrypted, which is an
+// error with -strict.
+func unlock(in []byte) (*pdflex.Crypt, error) {
+	d, err := pdflex.Open(bytes.NewReader(in))
 	if err != nil {
-		return "", err
+		fixed, _, rerr := pdflex.Repair(in)
+		if rerr == nil {
+			d, rerr = pdflex.Open(bytes.NewReader(fixed))
+		}
+		if rerr != nil {
+			if *flagStrict {
+				return nil, fmt.Errorf("can't check for encryption: %s", err)
+			}
+			return nil, nil
+		}
+	}
+	if !d.Encrypted() {
+		return nil, nil
+	}
+	if *flagPassword != "" {
+		err = d.Unlock(*flagPassword)
+	} else if d.Crypt == nil {
+		err = pdflex.ErrBadPassword
 	}
-	return b.String(), nil
+	if err != nil && *flagStrict {
+		return nil, fmt.Errorf("can't decrypt: %s", err)
+	}
+	return d.Crypt, nil
 }
 
 func shrink(in []byte, max int) ([]byte, error) {
+	c, err := unlock(in)
+	if err != nil {
+		return nil, err
+	}
 	l := pdflex.NewLexer("", string(in))
 	var out bytes.Buffer
-	zipped := false
-	asc85 := false
-	var err error
-
-	for i := l.NextItem(); i.Typ != pdflex.ItemEOF; i = l.NextItem() {
+	var length streamLength
+	var dict strings.Builder // the top level dict of the current object
+	var sig [2]pdflex.Item   // the last two significant items
+	num, gen := 0, 0         // of the current object
+	depth := 0
+	lengths := make(map[[2]int]int) // new values for indirect lengths
+
+	for i := l.Next(); i.Typ != pdflex.ItemEOF; i = l.Next() {
 		if i.Typ == pdflex.ItemStreamBody {
-
-			s := i.Val
-
-			if asc85 {
-				s, err = un85(s)
-				if err != nil && *flagStrict {
-					log.Fatalf("[STRICT] Failed to un85: %s", err)
-				}
+			sl := length
+			length = streamLength{}
+			var d pdflex.Dict
+			if o, err := pdflex.NewObjectParser(pdflex.NewLexer("", dict.String())).ParseObject(); err == nil {
+				d, _ = o.(pdflex.Dict)
 			}
+			dict.Reset()
 
-			if zipped {
-				s2, err := inflate(s)
-				if err != nil && *flagStrict {
-					log.Fatalf("[STRICT] Error unzipping internal stream: %s\n", err)
-				}
-				// If not strict, we ignore any errors here. If it's
-				// unexpected EOF we'll get partial unzipped data, so use
-				// that for truncation. Other errors will read a zero
-				// length string, in which case we fall back to truncating
-				// the original (corrupt) zipped stream.
-				if len(s2) > 0 {
-					s = s2
-				}
+			s, ok, err := shrinkBody(c, num, gen, d, i.Val, max)
+			if err != nil {
+				return nil, err
 			}
-
-			if len(s) > max {
-				s = s[:max]
-			} else {
+			if !ok {
 				// write the original string
 				out.WriteString(i.Val)
-				zipped = false
-				asc85 = false
 				continue
 			}
-
-			if zipped {
-				s, err = deflate(s)
-				if err != nil {
-					// should never happen, strict mode or not
-					return nil, fmt.Errorf("error zipping truncated string: %s", err)
+			if !*flagBadLen {
+				switch {
+				case sl.direct:
+					sl.setLength(&out, len(s))
+				case sl.isRef:
+					lengths[sl.ref] = len(s)
 				}
 			}
-			if asc85 {
-				s, err = re85(s)
-				if err != nil {
-					// ditto
-					return nil, fmt.Errorf("error Ascii85ing string: %s", err)
-				}
-			}
-
 			out.WriteString(s)
-			zipped = false
-			asc85 = false
-
-		} else {
+			continue
+		}
 
-			if i.Typ == pdflex.ItemName && i.Val == "/FlateDecode" {
-				zipped = true
+		switch i.Typ {
+		case pdflex.ItemLeftDict:
+			if depth == 0 {
+				dict.Reset()
 			}
-			if i.Typ == pdflex.ItemName && i.Val == "/ASCII85Decode" {
-				asc85 = true
+			depth++
+		case pdflex.ItemRightDict:
+			depth--
+		case pdflex.ItemObj, pdflex.ItemEndObj:
+			depth = 0
+			length = streamLength{}
+			dict.Reset()
+			if i.Typ == pdflex.ItemObj {
+				num, _ = strconv.Atoi(sig[0].Val)
+				gen, _ = strconv.Atoi(sig[1].Val)
 			}
-			out.WriteString(i.Val)
 		}
+		switch i.Typ {
+		case pdflex.ItemSpace, pdflex.ItemEOL, pdflex.ItemComment:
+		default:
+			length.see(i, out.Len(), depth)
+			sig[0], sig[1] = sig[1], i
+		}
+		if depth > 0 || i.Typ == pdflex.ItemRightDict {
+			dict.WriteString(i.Val)
+		}
+		out.WriteString(i.Val)
 
 		if i.Typ == pdflex.ItemError {
 			break
 		}
 	}
+	if len(lengths) > 0 {
+		return setIndirectLengths(out.Bytes(), lengths), nil
+	}
 	return out.Bytes(), nil
 }
 
-func fix(in []byte) []byte {
+func fix(in []byte) ([]byte, error) {
 	p := pdflex.Parser{Lexer: pdflex.NewLexer("", string(in))}
 	return p.FixXrefs()
 }
@@ -185,8 +310,23 @@ func shrinkWorker(in <-chan string, wg *sync.WaitGroup) {
 			continue
 		}
 
-		// Fix up xrefs
-		fixed := fix(shrunk)
+		// Fix up xrefs, or append a new one
+		var fixed []byte
+		if *flagRepair {
+			var rep *pdflex.RepairReport
+			fixed, rep, err = pdflex.Repair(shrunk)
+			if err != nil {
+				log.Printf("[SKIPPED] %s - repair failed: %s\n", arg, err)
+				continue
+			}
+			log.Printf("[REPAIRED] %s - %s\n", arg, rep)
+		} else {
+			fixed, err = fix(shrunk)
+			if err != nil {
+				log.Printf("[SKIPPED] %s - fix failed: %s\n", arg, err)
+				continue
+			}
+		}
 
 		// Write out
 		newfn := strings.TrimSuffix(path.Base(arg), path.Ext(arg)) + "-small" + path.Ext(arg)
@@ -204,7 +344,11 @@ func main() {
 		fmt.Fprintf(
 			os.Stderr,
 			"  Usage: %s file [file file ...]\n"+
+				"    -badlength=false: Leave /Length as it was for shrunk streams, so it is wrong\n"+
 				"    -max=128: Trim streams whose size is greater than this value\n"+
+				"    -password=\"\": User or owner password for encrypted files, if the user password isn't empty\n"+
+				"    -raw=false: Truncate streams that can't be decoded without decoding them\n"+
+				"    -repair=false: Rebuild the xref from scratch instead of fixing it\n"+
 				"    -strict=false: Abort on xref parsing errors etc\n"+
 				"    -workers=1: Number of concurrent workers to use\n",
 			path.Base(os.Args[0]),
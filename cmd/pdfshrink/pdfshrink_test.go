@@ -5,9 +5,12 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"github.com/bnagy/pdflex"
+	"github.com/bnagy/pdflex/filters"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +33,13 @@ var tf85 = testFile{
 	md5:  "fa7e8078b43b17c6b79deabb8f143ca2",
 }
 
+// AES-128 encrypted, with an empty user password and "owner" as the owner
+// password. Object 3 is a Flate content stream.
+var tfAES = testFile{
+	name: "test-aes.pdf",
+	md5:  "860802300edf8e58f367a8ca453b533f",
+}
+
 func openVerify(tf testFile) ([]byte, error) {
 
 	fr, err := os.Open(tf.name)
@@ -55,12 +65,21 @@ func openVerify(tf testFile) ([]byte, error) {
 func TestRewrite(t *testing.T) {
 	contents, err := openVerify(tfUnmodified)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
+	}
+	// The /Prev in the last trailer is stale (past EOF) in the test file, so
+	// it should be pointed at the first xref, padded to the same width.
+	want := bytes.Replace(contents, []byte("/Prev 425853"), []byte("/Prev 16196 "), 1)
+	fixed, err := fix(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixed) != len(want) {
+		t.Fatalf("%s changed size during fix()", tfUnmodified.name)
 	}
-	fixed := fix(contents)
 	for i, b := range fixed {
-		if b != contents[i] {
-			t.Fatalf("%s was modified during fix()", tfUnmodified.name)
+		if b != want[i] {
+			t.Fatalf("%s was modified during fix() at %d", tfUnmodified.name, i)
 		}
 	}
 }
@@ -68,10 +87,17 @@ func TestRewrite(t *testing.T) {
 func TestShrink(t *testing.T) {
 	contents, err := openVerify(tf85)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
-	shrink128, err := shrink(contents, 128) // should be a noop
-	for i, b := range shrink128 {
+	// should be a noop, nothing decodes to anywhere near this
+	shrinkBig, err := shrink(contents, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shrinkBig) != len(contents) {
+		t.Fatalf("%s changed size during shrink()", tf85.name)
+	}
+	for i, b := range shrinkBig {
 		if b != contents[i] {
 			t.Fatalf("%s was modified during shrink()", tf85.name)
 		}
@@ -82,11 +108,212 @@ func TestShrink(t *testing.T) {
 		t.Fatalf("error while shrinking: %s", err)
 	}
 
-	shrink127 = fix(shrink127)
+	shrink127, err = fix(shrink127)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The exact offset depends on what zlib makes of the truncated streams,
+	// which changes between Go versions, so just check it's right.
 	idx := bytes.LastIndex(shrink127, []byte("startxref"))
-	want := "startxref\r55370"
-	got := string(shrink127[idx : idx+len(want)])
-	if got != want {
-		t.Fatalf("unexpected value at startxref, want %q, got %q", want, got)
+	var off int
+	if _, err := fmt.Sscan(string(shrink127[idx+len("startxref"):]), &off); err != nil {
+		t.Fatalf("no offset after startxref: %s", err)
+	}
+	if !bytes.HasPrefix(shrink127[off:], []byte("xref")) {
+		t.Fatalf("startxref %d doesn't point to the xref", off)
+	}
+
+	// Every direct /Length should have been updated. The DCT images in the
+	// test file were already cut short without fixing their /Length, and we
+	// can't decode them, so those stay wrong.
+	old := make(map[[2]int]int)
+	for _, m := range mismatches(contents) {
+		old[[2]int{m.Length, m.Actual}]++
+	}
+	for _, m := range mismatches(shrink127) {
+		k := [2]int{m.Length, m.Actual}
+		if old[k] == 0 {
+			t.Fatalf("stream has the wrong /Length: %+v", m)
+		}
+		old[k]--
+	}
+}
+
+func mismatches(in []byte) []pdflex.LengthMismatch {
+	l := pdflex.NewLexer("", string(in))
+	for i := l.Next(); i.Typ != pdflex.ItemEOF; i = l.Next() {
+	}
+	return l.LengthMismatches()
+}
+
+func TestShrinkFilters(t *testing.T) {
+	data := []byte(strings.Repeat("0 0 m 10 10 l S\n", 8))
+	chain := []filters.Filter{{Name: "ASCII85Decode"}, {Name: "FlateDecode"}}
+	enc, err := filters.Encode(data, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filters in object 1, and in the /DecodeParms of object 2, don't
+	// apply to the plain stream in object 2.
+	in := []byte(fmt.Sprintf("1 0 obj\n<< /Filter /FlateDecode >>\nendobj\n"+
+		"2 0 obj\n<< /DecodeParms << /Filter /ASCII85Decode >> /Length %d >>\nstream\n%s\nendstream\nendobj\n"+
+		"3 0 obj\n<< /Length %d /Filter [/ASCII85Decode /FlateDecode] >>\nstream\n%s\nendstream\nendobj\n"+
+		"4 0 obj\n<< /Length 64 /Filter /DCTDecode >>\nstream\n%s\nendstream\nendobj\n",
+		len(data), data, len(enc), enc, strings.Repeat("x", 64)))
+
+	out, err := shrink(in, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("/Length 16 >>\nstream\n0 0 m 10 10 l S\n\nendstream")) {
+		t.Fatalf("plain stream wasn't truncated as it is\n%s", out)
+	}
+	p := pdflex.NewObjectParser(pdflex.NewLexer("", string(out)))
+	for {
+		o, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj := o.(pdflex.IndirectObject); obj.Num == 3 {
+			got, err := obj.Value.(pdflex.Stream).Decode()
+			if err != nil || !bytes.Equal(got, data[:16]) {
+				t.Fatalf("bad shrunk ASCII85 Flate stream %q %v", got, err)
+			}
+		}
+	}
+	dct := "/Length 64 /Filter /DCTDecode >>\nstream\n" + strings.Repeat("x", 64)
+	if !bytes.Contains(out, []byte(dct)) {
+		t.Fatalf("DCT stream was modified without -raw\n%s", out)
+	}
+
+	*flagRaw = true
+	defer func() { *flagRaw = false }()
+	out, err = shrink(in, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dct = "/Length 16 /Filter /DCTDecode >>\nstream\n" + strings.Repeat("x", 16) + "\n"
+	if !bytes.Contains(out, []byte(dct)) {
+		t.Fatalf("DCT stream wasn't truncated with -raw\n%s", out)
+	}
+}
+
+func TestShrinkTruncatedFlate(t *testing.T) {
+	data := make([]byte, 2000)
+	for j := range data {
+		data[j] = byte(j * j >> 3)
+	}
+	enc, err := filters.Encode(data, []filters.Filter{{Name: "FlateDecode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc = enc[:len(enc)/2]
+	in := []byte(fmt.Sprintf("1 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream\nendobj\n",
+		len(enc), enc))
+
+	out, err := shrink(in, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := pdflex.NewObjectParser(pdflex.NewLexer("", string(out))).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := o.(pdflex.IndirectObject).Value.(pdflex.Stream).Decode()
+	if err != nil || !bytes.Equal(got, data[:128]) {
+		t.Fatalf("truncated Flate stream wasn't shrunk from what could be inflated: %d bytes, %v", len(got), err)
+	}
+
+	*flagStrict = true
+	defer func() { *flagStrict = false }()
+	if _, err := shrink(in, 128); err == nil {
+		t.Fatalf("truncated Flate stream wasn't an error with -strict")
+	}
+}
+
+func TestShrinkKeepsXrefStreams(t *testing.T) {
+	for _, typ := range []string{"/XRef", "/ObjStm"} {
+		in := []byte("1 0 obj\n<< /Type " + typ + " /Length 32 >>\nstream\n" +
+			strings.Repeat("x", 32) + "\nendstream\nendobj\n")
+		out, err := shrink(in, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("%s stream was modified during shrink()", typ)
+		}
+	}
+}
+
+func TestShrinkRepair(t *testing.T) {
+	contents, err := openVerify(tf85)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrunk, err := shrink(contents, 16)
+	if err != nil {
+		t.Fatalf("error while shrinking: %s", err)
+	}
+	repaired, rep, err := pdflex.Repair(shrunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := pdflex.Open(bytes.NewReader(repaired))
+	if err != nil {
+		t.Fatalf("repaired file doesn't open: %s", err)
+	}
+	if _, err := d.Resolve(rep.Root); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShrinkEncrypted(t *testing.T) {
+	contents, err := openVerify(tfAES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrunk, err := shrink(contents, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shrunk, err = fix(shrunk); err != nil {
+		t.Fatal(err)
+	}
+	d, err := pdflex.Open(bytes.NewReader(shrunk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Crypt == nil {
+		t.Fatalf("shrunk file can't be decrypted")
+	}
+	o, err := d.Resolve(pdflex.Ref{Num: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := o.(pdflex.Stream)
+	data, err := s.Decode()
+	if err != nil || string(data) != "BT /F1 12 Tf 72 " {
+		t.Fatalf("bad shrunk stream %q %v", data, err)
+	}
+	if bytes.Contains(shrunk, data) {
+		t.Fatalf("shrunk stream wasn't encrypted again")
+	}
+
+	// The empty user password still works, but -strict wants -password right
+	*flagPassword = "wrong"
+	defer func() { *flagPassword = "" }()
+	*flagStrict = true
+	defer func() { *flagStrict = false }()
+	if _, err := shrink(contents, 16); err == nil {
+		t.Fatalf("wrong password wasn't an error with -strict")
+	}
+
+	// Nor can it shrink a file it can't check for encryption
+	*flagPassword = ""
+	if _, err := shrink([]byte("%PDF-1.1\n1 0 obj\n(no catalog)\nendobj\n"), 16); err == nil {
+		t.Fatalf("unreadable file wasn't an error with -strict")
 	}
 }
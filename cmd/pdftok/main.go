@@ -4,35 +4,45 @@ import (
 	"flag"
 	"fmt"
 	"github.com/bnagy/pdflex"
-	"io/ioutil"
 	"os"
 	"path"
 )
 
+var flagRecover = flag.Bool("recover", false, "Keep lexing after errors")
+
 func main() {
 
 	flag.Usage = func() {
 		fmt.Fprintf(
 			os.Stderr,
-			"  Usage: %s file [file file ...]\n",
+			"  Usage: %s file [file file ...]\n"+
+				"    -recover=false: Keep lexing after errors\n",
 			path.Base(os.Args[0]),
 		)
 	}
 
-	for _, arg := range os.Args[1:] {
-		raw, err := ioutil.ReadFile(arg)
+	flag.Parse()
+	for _, arg := range flag.Args() {
+		f, err := os.Open(arg)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Unable to open %s: %s", arg, err)
 			os.Exit(1)
 		}
-		l := pdflex.NewLexer(arg, string(raw))
-		for i := l.NextItem(); i.Typ != pdflex.ItemEOF; i = l.NextItem() {
+		l := pdflex.NewReaderLexer(arg, f)
+		if *flagRecover {
+			l.SetMode(pdflex.Recover)
+		}
+		for i := range l.Items() {
 			fmt.Printf("%#v\n", i)
 			if i.Typ == pdflex.ItemError {
-				fmt.Fprintf(os.Stderr, "Aborting %s at line %d, pos %d\n", arg, l.LineNumber(), l.Pos())
-				break
+				if !*flagRecover {
+					fmt.Fprintf(os.Stderr, "Aborting %s at line %d, col %d: %s\n", arg, i.Line, i.Col, i.Val)
+					break
+				}
+				fmt.Fprintf(os.Stderr, "Error in %s at line %d, col %d: %s\n", arg, i.Line, i.Col, i.Val)
 			}
 		}
+		f.Close()
 	}
 
 }
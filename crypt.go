@@ -0,0 +1,552 @@
+package pdflex
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Spec: 7.6.1 - 7.6.3
+// An encrypted document has an /Encrypt entry in its trailer, and the first
+// element of the trailer /ID feeds into the file encryption key. Every string
+// and stream in the file is then encrypted with a key derived from the file
+// key and the number and generation of the object it is in, apart from the
+// /Encrypt dict itself, xref streams, strings inside object streams (the
+// object stream is encrypted as a whole) and, if /EncryptMetadata is false,
+// /Metadata streams.
+//
+// The Standard security handler (7.6.3) derives the file key from a
+// password. The user password, often empty, is enough to read the document;
+// the owner password can recover the user password. /V and /R pick the
+// algorithms:
+//   V 1, R 2     - RC4, 40 bit key
+//   V 2, R 3     - RC4, 40 to 128 bit key
+//   V 4, R 4     - crypt filters (7.6.5) choosing RC4 or AES-128 (AESV2)
+//   V 5, R 5 / 6 - crypt filters with AES-256 (AESV3), from ISO 32000-2
+// AES data starts with a random 16 byte IV and is padded as in PKCS#5.
+
+var (
+	// ErrEncrypted is returned when reading objects from an encrypted
+	// Document that hasn't been unlocked.
+	ErrEncrypted = errors.New("document is encrypted")
+	// ErrBadPassword is returned when a password matches neither the user
+	// nor the owner password.
+	ErrBadPassword = errors.New("incorrect password")
+)
+
+// padding pads or replaces passwords for revisions 2 to 4, Algorithm 2 step a.
+var padding = []byte{
+	0x28, 0xbf, 0x4e, 0x5e, 0x4e, 0x75, 0x8a, 0x41, 0x64, 0x00, 0x4e, 0x56, 0xff, 0xfa, 0x01, 0x08,
+	0x2e, 0x2e, 0x00, 0xb6, 0xd0, 0x68, 0x3e, 0x80, 0x2f, 0x0c, 0xa9, 0xfe, 0x64, 0x53, 0x69, 0x7a,
+}
+
+// cryptMethod is the /CFM of a crypt filter.
+type cryptMethod int
+
+const (
+	methodIdentity cryptMethod = iota // not encrypted
+	methodRC4                         // V2
+	methodAESV2                       // AES-128
+	methodAESV3                       // AES-256
+)
+
+// Crypt encrypts and decrypts the strings and streams of a document that uses
+// the Standard security handler. It is created from the /Encrypt dict with
+// NewCrypt, or by Document.Unlock.
+type Crypt struct {
+	V, R  int  // algorithm and revision from the /Encrypt dict
+	Owner bool // unlocked with the owner password, not the user password
+	key   []byte
+	stm   cryptMethod // for streams
+	str   cryptMethod // for strings
+	meta  bool        // /EncryptMetadata
+	crypt map[string]cryptMethod
+}
+
+// NewCrypt authenticates password against the /Encrypt dict e, trying it as
+// the user password and then as the owner password, and returns a Crypt with
+// the file encryption key. id is the first element of the trailer /ID, which
+// revision 5 and 6 don't use. If the password doesn't match the error is
+// ErrBadPassword.
+func NewCrypt(e Dict, id []byte, password string) (*Crypt, error) {
+	if f, ok := e.Get("Filter").(Name); !ok || f.Value != "Standard" {
+		return nil, fmt.Errorf("unsupported security handler")
+	}
+	v, ok1 := dictInt(e, "V", 0)
+	r, ok2 := dictInt(e, "R", 0)
+	bits, ok3 := dictInt(e, "Length", 40)
+	p, ok4 := dictInt(e, "P", 0)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, fmt.Errorf("invalid /Encrypt dict")
+	}
+	c := &Crypt{V: v, R: r, meta: true}
+	if b, ok := e.Get("EncryptMetadata").(Bool); ok {
+		c.meta = b.Value
+	}
+
+	n := 0 // key length in bytes
+	switch {
+	case v == 1 && r == 2:
+		n, c.stm, c.str = 5, methodRC4, methodRC4
+	case v == 2 && (r == 2 || r == 3):
+		n, c.stm, c.str = bits/8, methodRC4, methodRC4
+		if r == 2 {
+			n = 5
+		}
+	case v == 4 && r == 4, v == 5 && (r == 5 || r == 6):
+		if err := c.cryptFilters(e); err != nil {
+			return nil, err
+		}
+		n = 16
+		if o := e.Get("Length"); o != nil && v == 4 {
+			n = bits / 8
+		}
+		if v == 5 {
+			n = 32
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encryption /V %d /R %d", v, r)
+	}
+	if n < 5 || n > 32 || (v < 5 && n > 16) {
+		return nil, fmt.Errorf("invalid key /Length %d", bits)
+	}
+	if v == 4 && n != 16 && c.uses(methodAESV2) {
+		return nil, fmt.Errorf("AESV2 needs a 128 bit key, not /Length %d", bits)
+	}
+
+	o, _ := e.Get("O").(String)
+	u, _ := e.Get("U").(String)
+	if r >= 5 {
+		oe, _ := e.Get("OE").(String)
+		ue, _ := e.Get("UE").(String)
+		if len(o.Value) < 48 || len(u.Value) < 48 || len(oe.Value) < 32 || len(ue.Value) < 32 {
+			return nil, fmt.Errorf("invalid /O, /U, /OE or /UE")
+		}
+		pw := []byte(password)
+		if len(pw) > 127 {
+			pw = pw[:127]
+		}
+		if c.key = c.unlockAES256(pw, u.Value[:48], nil, ue.Value[:32]); c.key != nil {
+			return c, nil
+		}
+		if c.key = c.unlockAES256(pw, o.Value[:48], u.Value[:48], oe.Value[:32]); c.key != nil {
+			c.Owner = true
+			return c, nil
+		}
+		return nil, ErrBadPassword
+	}
+
+	if len(o.Value) < 32 || len(u.Value) < 32 {
+		return nil, fmt.Errorf("invalid /O or /U")
+	}
+	o.Value, u.Value = o.Value[:32], u.Value[:32]
+	if c.key = c.unlockRC4(pad(password), o.Value, u.Value, int32(p), id, n); c.key != nil {
+		return c, nil
+	}
+	// Algorithm 7: the owner password is the key that decrypts /O into the
+	// padded user password
+	k := ownerKey(pad(password), r, n)
+	user := append([]byte(nil), o.Value...)
+	if r == 2 {
+		rc4XOR(k, user)
+	} else {
+		for j := 19; j >= 0; j-- {
+			rc4XOR(xorKey(k, byte(j)), user)
+		}
+	}
+	if c.key = c.unlockRC4(user, o.Value, u.Value, int32(p), id, n); c.key != nil {
+		c.Owner = true
+		return c, nil
+	}
+	return nil, ErrBadPassword
+}
+
+// cryptFilters reads /CF, /StmF and /StrF for V 4 and 5.
+func (c *Crypt) cryptFilters(e Dict) error {
+	c.crypt = map[string]cryptMethod{"Identity": methodIdentity}
+	cf, _ := e.Get("CF").(Dict)
+	for _, entry := range cf.Entries {
+		f, ok := entry.Value.(Dict)
+		if !ok {
+			return fmt.Errorf("crypt filter %s is not a dict", entry.Key.Raw)
+		}
+		m, _ := f.Get("CFM").(Name)
+		switch m.Value {
+		case "V2":
+			c.crypt[entry.Key.Value] = methodRC4
+		case "AESV2":
+			c.crypt[entry.Key.Value] = methodAESV2
+		case "AESV3":
+			c.crypt[entry.Key.Value] = methodAESV3
+		default:
+			// None means the application decrypts, which we can't
+			return fmt.Errorf("unsupported crypt filter method %q", m.Value)
+		}
+	}
+	var err error
+	if c.stm, err = c.method(e, "StmF"); err != nil {
+		return err
+	}
+	c.str, err = c.method(e, "StrF")
+	return err
+}
+
+// uses reports whether m is used by any crypt filter, or for streams or
+// strings.
+func (c *Crypt) uses(m cryptMethod) bool {
+	if c.stm == m || c.str == m {
+		return true
+	}
+	for _, cm := range c.crypt {
+		if cm == m {
+			return true
+		}
+	}
+	return false
+}
+
+// method returns the crypt method of the crypt filter named by key in d.
+func (c *Crypt) method(d Dict, key string) (cryptMethod, error) {
+	name := "Identity"
+	if n, ok := d.Get(key).(Name); ok {
+		name = n.Value
+	}
+	m, ok := c.crypt[name]
+	if !ok {
+		return 0, fmt.Errorf("no crypt filter %s", name)
+	}
+	return m, nil
+}
+
+// pad pads or truncates a password to 32 bytes.
+func pad(password string) []byte {
+	b := append([]byte(password), padding...)
+	return b[:32]
+}
+
+// unlockRC4 returns the file key for the padded user password pw, or nil if
+// it's wrong. Algorithm 2 computes the key, and Algorithm 4 or 5 the /U it
+// should produce.
+func (c *Crypt) unlockRC4(pw, o, u []byte, p int32, id []byte, n int) []byte {
+	h := md5.New()
+	h.Write(pw)
+	h.Write(o)
+	h.Write([]byte{byte(p), byte(p >> 8), byte(p >> 16), byte(p >> 24)})
+	h.Write(id)
+	if c.R >= 4 && !c.meta {
+		h.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+	key := h.Sum(nil)
+	if c.R >= 3 {
+		for j := 0; j < 50; j++ {
+			sum := md5.Sum(key[:n])
+			key = sum[:]
+		}
+	}
+	key = key[:n]
+
+	if c.R == 2 {
+		check := append([]byte(nil), padding...)
+		rc4XOR(key, check)
+		if bytes.Equal(check, u) {
+			return key
+		}
+		return nil
+	}
+	h = md5.New()
+	h.Write(padding)
+	h.Write(id)
+	check := h.Sum(nil)
+	for j := 0; j < 20; j++ {
+		rc4XOR(xorKey(key, byte(j)), check)
+	}
+	// only the first 16 bytes of /U are significant
+	if bytes.Equal(check, u[:16]) {
+		return key
+	}
+	return nil
+}
+
+// ownerKey is the RC4 key used to encrypt /O, from the padded owner
+// password. Algorithm 3 steps a to d.
+func ownerKey(pw []byte, r, n int) []byte {
+	sum := md5.Sum(pw)
+	key := sum[:]
+	if r >= 3 {
+		for j := 0; j < 50; j++ {
+			sum = md5.Sum(key)
+			key = sum[:]
+		}
+	} else {
+		n = 5
+	}
+	return key[:n]
+}
+
+// xorKey returns key with every byte XORed with b.
+func xorKey(key []byte, b byte) []byte {
+	k := make([]byte, len(key))
+	for j := range key {
+		k[j] = key[j] ^ b
+	}
+	return k
+}
+
+// rc4XOR encrypts or decrypts data in place.
+func rc4XOR(key, data []byte) {
+	c, err := rc4.NewCipher(key)
+	if err != nil {
+		panic(err) // keys are always 1 to 256 bytes
+	}
+	c.XORKeyStream(data, data)
+}
+
+// unlockAES256 returns the file key, or nil if the password is wrong,
+// following Algorithm 2.A. ou is /O or /U: a 32 byte hash, 8 bytes of
+// validation salt and 8 bytes of key salt. extra is /U when checking the
+// owner password, and e is /OE or /UE, the encrypted file key.
+func (c *Crypt) unlockAES256(pw, ou, extra, e []byte) []byte {
+	if !bytes.Equal(c.hash(pw, ou[32:40], extra), ou[:32]) {
+		return nil
+	}
+	k := c.hash(pw, ou[40:48], extra)
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil
+	}
+	key := make([]byte, 32)
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(key, e)
+	return key
+}
+
+// hash is the password hash for revision 5, which is plain SHA-256, or
+// revision 6, Algorithm 2.B. It returns nil if the hash can't be computed.
+func (c *Crypt) hash(pw, salt, extra []byte) []byte {
+	h := sha256.New()
+	h.Write(pw)
+	h.Write(salt)
+	h.Write(extra)
+	k := h.Sum(nil)
+	if c.R == 5 {
+		return k
+	}
+
+	for round := 0; ; round++ {
+		k1 := make([]byte, 0, 64*(len(pw)+len(k)+len(extra)))
+		for j := 0; j < 64; j++ {
+			k1 = append(k1, pw...)
+			k1 = append(k1, k...)
+			k1 = append(k1, extra...)
+		}
+		block, err := aes.NewCipher(k[:16])
+		if err != nil {
+			return nil
+		}
+		cipher.NewCBCEncrypter(block, k[16:32]).CryptBlocks(k1, k1)
+		// the first 16 bytes as a big number mod 3 is the same as the sum
+		// of the bytes mod 3, since 256 mod 3 is 1
+		sum := 0
+		for _, b := range k1[:16] {
+			sum += int(b)
+		}
+		var h hash.Hash
+		switch sum % 3 {
+		case 0:
+			h = sha256.New()
+		case 1:
+			h = sha512.New384()
+		case 2:
+			h = sha512.New()
+		}
+		h.Write(k1)
+		k = h.Sum(nil)
+		if round >= 63 && int(k1[len(k1)-1]) <= round-31 {
+			break
+		}
+	}
+	return k[:32]
+}
+
+// objectKey derives the key for one object with Algorithm 1. AES-256 uses
+// the file key as it is.
+func (c *Crypt) objectKey(num, gen int, m cryptMethod) []byte {
+	if m == methodAESV3 {
+		return c.key
+	}
+	h := md5.New()
+	h.Write(c.key)
+	h.Write([]byte{byte(num), byte(num >> 8), byte(num >> 16), byte(gen), byte(gen >> 8)})
+	if m == methodAESV2 {
+		h.Write([]byte("sAlT"))
+	}
+	n := len(c.key) + 5
+	if n > 16 {
+		n = 16
+	}
+	return h.Sum(nil)[:n]
+}
+
+// decrypt returns data from object num gen decrypted with method m.
+func (c *Crypt) decrypt(num, gen int, m cryptMethod, data []byte) ([]byte, error) {
+	switch m {
+	case methodIdentity:
+		return data, nil
+	case methodRC4:
+		out := append([]byte(nil), data...)
+		rc4XOR(c.objectKey(num, gen, m), out)
+		return out, nil
+	}
+	if len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("AES data is %d bytes, not a whole number of blocks after the IV", len(data))
+	}
+	block, err := aes.NewCipher(c.objectKey(num, gen, m))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(out, data[aes.BlockSize:])
+	n := int(out[len(out)-1])
+	if n < 1 || n > aes.BlockSize {
+		return nil, fmt.Errorf("invalid AES padding")
+	}
+	return out[:len(out)-n], nil
+}
+
+// encrypt returns data for object num gen encrypted with method m. AES uses a
+// random IV.
+func (c *Crypt) encrypt(num, gen int, m cryptMethod, data []byte) ([]byte, error) {
+	switch m {
+	case methodIdentity:
+		return data, nil
+	case methodRC4:
+		out := append([]byte(nil), data...)
+		rc4XOR(c.objectKey(num, gen, m), out)
+		return out, nil
+	}
+	block, err := aes.NewCipher(c.objectKey(num, gen, m))
+	if err != nil {
+		return nil, err
+	}
+	n := aes.BlockSize - len(data)%aes.BlockSize
+	out := make([]byte, aes.BlockSize, aes.BlockSize+len(data)+n)
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	out = append(out, data...)
+	out = append(out, bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, out[:aes.BlockSize]).CryptBlocks(out[aes.BlockSize:], out[aes.BlockSize:])
+	return out, nil
+}
+
+// Decrypt returns a copy of o, which belongs to object num gen, with every
+// string and stream body in it decrypted. An IndirectObject uses its own
+// number instead. Streams that aren't encrypted, like xref streams, are
+// returned as they are. The Raw spelling of decrypted strings is rewritten to
+// match.
+func (c *Crypt) Decrypt(num, gen int, o Object) (Object, error) {
+	return c.walk(num, gen, o, c.decrypt)
+}
+
+// Encrypt is the reverse of Decrypt, so a document can be written out with
+// the same encryption it was read with.
+func (c *Crypt) Encrypt(num, gen int, o Object) (Object, error) {
+	return c.walk(num, gen, o, c.encrypt)
+}
+
+type cryptFunc func(num, gen int, m cryptMethod, data []byte) ([]byte, error)
+
+func (c *Crypt) walk(num, gen int, o Object, f cryptFunc) (Object, error) {
+	switch v := o.(type) {
+	case String:
+		b, err := f(num, gen, c.str, v.Value)
+		if err != nil {
+			return nil, fmt.Errorf("string at pos %d: %s", v.span.Start, err)
+		}
+		if c.str != methodIdentity {
+			v.Value, v.Raw = b, spellString(b, v.Hex)
+		}
+		return v, nil
+	case Array:
+		a := v
+		a.Elems = make([]Object, len(v.Elems))
+		for j, e := range v.Elems {
+			var err error
+			if a.Elems[j], err = c.walk(num, gen, e, f); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case Dict:
+		d := v
+		d.Entries = make([]DictEntry, len(v.Entries))
+		for j, e := range v.Entries {
+			val, err := c.walk(num, gen, e.Value, f)
+			if err != nil {
+				return nil, err
+			}
+			d.Entries[j] = DictEntry{e.Key, val}
+		}
+		return d, nil
+	case Stream:
+		if isXrefStream(v) {
+			return v, nil
+		}
+		m, err := c.streamMethod(v.Dict)
+		if err != nil {
+			return nil, err
+		}
+		d, err := c.walk(num, gen, v.Dict, f)
+		if err != nil {
+			return nil, err
+		}
+		s := v
+		s.Dict = d.(Dict)
+		if s.Raw, err = f(num, gen, m, v.Raw); err != nil {
+			return nil, fmt.Errorf("stream at pos %d: %s", v.span.Start, err)
+		}
+		return s, nil
+	case IndirectObject:
+		val, err := c.walk(v.Num, v.Gen, v.Value, f)
+		if err != nil {
+			return nil, err
+		}
+		v.Value = val
+		return v, nil
+	}
+	return o, nil
+}
+
+// streamMethod returns the crypt method for a stream with dict d. A /Crypt
+// filter, which must come first, names the crypt filter to use instead of
+// /StmF.
+func (c *Crypt) streamMethod(d Dict) (cryptMethod, error) {
+	if t, ok := d.Get("Type").(Name); ok && t.Value == "Metadata" && !c.meta {
+		return methodIdentity, nil
+	}
+	var first Object
+	var parms Object
+	switch f := d.Get("Filter").(type) {
+	case Name:
+		first, parms = f, d.Get("DecodeParms")
+	case Array:
+		if len(f.Elems) > 0 {
+			first = f.Elems[0]
+		}
+		if a, ok := d.Get("DecodeParms").(Array); ok && len(a.Elems) > 0 {
+			parms = a.Elems[0]
+		}
+	}
+	if n, ok := first.(Name); ok && n.Value == "Crypt" {
+		p, _ := parms.(Dict)
+		return c.method(p, "Name")
+	}
+	return c.stm, nil
+}
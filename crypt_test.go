@@ -0,0 +1,300 @@
+package pdflex
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"strings"
+	"testing"
+)
+
+type cryptCase struct {
+	name string
+	v, r int
+	bits int
+	cfm  string // for V 4 and 5
+}
+
+var cryptCases = []cryptCase{
+	{"RC4 40", 1, 2, 40, ""},
+	{"RC4 128", 2, 3, 128, ""},
+	{"AES-128", 4, 4, 128, "AESV2"},
+	{"AES-256", 5, 6, 256, "AESV3"},
+}
+
+var testID = []byte("0123456789abcdef")
+
+// encryptDict builds an /Encrypt dict for the passwords the way a writer
+// would, with Algorithms 3, 4 and 5, or 8 and 9 for R 6. Unlocking uses
+// different algorithms, so this checks them against each other.
+func encryptDict(c cryptCase, user, owner string) string {
+	h := func(b []byte) string { return hex.EncodeToString(b) }
+	if c.r == 6 {
+		key := []byte("0123456789abcdefghijklmnopqrstuv")
+		cr := &Crypt{R: 6}
+		noIV := func(k []byte) []byte {
+			block, _ := aes.NewCipher(k)
+			out := make([]byte, 32)
+			cipher.NewCBCEncrypter(block, make([]byte, 16)).CryptBlocks(out, key)
+			return out
+		}
+		u := append(cr.hash([]byte(user), []byte("uvsaltxx"), nil), "uvsaltxxuksaltxx"...)
+		ue := noIV(cr.hash([]byte(user), []byte("uksaltxx"), nil))
+		o := append(cr.hash([]byte(owner), []byte("ovsaltxx"), u), "ovsaltxxoksaltxx"...)
+		oe := noIV(cr.hash([]byte(owner), []byte("oksaltxx"), u))
+		return fmt.Sprintf("<< /Filter /Standard /V 5 /R 6 /Length 256 /P -3904 /O <%s> /U <%s> /OE <%s> /UE <%s> "+
+			"/Perms <00000000000000000000000000000000> /CF << /StdCF << /CFM /AESV3 /Length 32 >> >> /StmF /StdCF /StrF /StdCF >>",
+			h(o), h(u), h(oe), h(ue))
+	}
+
+	n := c.bits / 8
+	// Algorithm 3 rehashes the whole hash, Algorithm 2 only n bytes of it
+	md5n := func(b []byte, m int) []byte {
+		sum := md5.Sum(b)
+		if c.r >= 3 {
+			for j := 0; j < 50; j++ {
+				sum = md5.Sum(sum[:m])
+			}
+		}
+		return sum[:n]
+	}
+	rc4n := func(key, data []byte) {
+		rc4XOR(key, data)
+		for j := 1; c.r >= 3 && j < 20; j++ {
+			rc4XOR(xorKey(key, byte(j)), data)
+		}
+	}
+	pu, po := pad(user), pad(owner)
+	o := append([]byte(nil), pu...)
+	rc4n(md5n(po, 16), o)
+	p := int32(-3904)
+	key := md5n(append(append(append(append([]byte(nil), pu...), o...),
+		byte(p), byte(p>>8), byte(p>>16), byte(p>>24)), testID...), n)
+	var u []byte
+	if c.r == 2 {
+		u = append([]byte(nil), padding...)
+		rc4XOR(key, u)
+	} else {
+		sum := md5.Sum(append(append([]byte(nil), padding...), testID...))
+		u = append(sum[:], make([]byte, 16)...)
+		rc4n(key, u[:16])
+	}
+	cf := ""
+	if c.v == 4 {
+		cf = fmt.Sprintf(" /CF << /StdCF << /CFM /%s /Length 16 >> >> /StmF /StdCF /StrF /StdCF", c.cfm)
+	}
+	return fmt.Sprintf("<< /Filter /Standard /V %d /R %d /Length %d /P %d /O <%s> /U <%s>%s >>",
+		c.v, c.r, c.bits, p, h(o), h(u), cf)
+}
+
+var cryptContent = bytes.Repeat([]byte("BT /F1 12 Tf 72 712 Td (Secret) Tj ET\n"), 4)
+
+// encryptedPDF returns a document encrypted as c, with a string in object 2
+// and a Flate stream in object 3.
+func encryptedPDF(t *testing.T, c cryptCase, user, owner string) []byte {
+	e := encryptDict(c, user, owner)
+	o, err := NewObjectParser(NewLexer("", e)).ParseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewCrypt(o.(Dict), testID, user)
+	if err != nil {
+		t.Fatalf("%s: %s", c.name, err)
+	}
+	title, err := cr.encrypt(2, 0, cr.str, []byte("Top (Secret)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := filters.Encode(cryptContent, []filters.Filter{{Name: "FlateDecode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err = cr.encrypt(3, 0, cr.stm, body); err != nil {
+		t.Fatal(err)
+	}
+	in := fmt.Sprintf("%%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n"+
+		"2 0 obj\n<< /Title %s >>\nendobj\n"+
+		"3 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream\nendobj\n"+
+		"4 0 obj\n%s\nendobj\n"+
+		"trailer\n<< /Root 1 0 R /Encrypt 4 0 R /ID [<%x> <%x>] >>\n",
+		spellString(title, false), len(body), body, e, testID, testID)
+	out, _, err := Repair([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// checkDecrypted checks that the string and stream in a document from
+// encryptedPDF come out right.
+func checkDecrypted(t *testing.T, name string, d *Document) {
+	o, err := d.Resolve(Ref{Num: 2})
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	if s := o.(Dict).Get("Title").(String); string(s.Value) != "Top (Secret)" || s.Raw != `(Top \(Secret\))` {
+		t.Fatalf("%s: bad string %q %s", name, s.Value, s.Raw)
+	}
+	o, err = d.Resolve(Ref{Num: 3})
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	data, err := o.(Stream).Decode()
+	if err != nil || !bytes.Equal(data, cryptContent) {
+		t.Fatalf("%s: bad stream %q %v", name, data, err)
+	}
+}
+
+func TestCryptEmptyUserPassword(t *testing.T) {
+	for _, c := range cryptCases {
+		d, err := Open(bytes.NewReader(encryptedPDF(t, c, "", "owner")))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if d.Crypt == nil || d.Crypt.Owner {
+			t.Fatalf("%s: not unlocked with the empty user password", c.name)
+		}
+		checkDecrypted(t, c.name, d)
+	}
+}
+
+func TestCryptPasswords(t *testing.T) {
+	for _, c := range cryptCases {
+		d, err := Open(bytes.NewReader(encryptedPDF(t, c, "user", "owner")))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if _, err := d.Resolve(Ref{Num: 2}); !errors.Is(err, ErrEncrypted) {
+			t.Fatalf("%s: want ErrEncrypted before unlocking, got %v", c.name, err)
+		}
+		if err := d.Unlock("wrong"); !errors.Is(err, ErrBadPassword) {
+			t.Fatalf("%s: want ErrBadPassword, got %v", c.name, err)
+		}
+		if err := d.Unlock("owner"); err != nil || !d.Crypt.Owner {
+			t.Fatalf("%s: owner password didn't unlock: %v", c.name, err)
+		}
+		checkDecrypted(t, c.name, d)
+		if err := d.Unlock("user"); err != nil || d.Crypt.Owner {
+			t.Fatalf("%s: user password didn't unlock: %v", c.name, err)
+		}
+		checkDecrypted(t, c.name, d)
+	}
+}
+
+func TestCryptUnsupported(t *testing.T) {
+	in := bytes.Replace(encryptedPDF(t, cryptCases[0], "", "owner"), []byte("/V 1 /R 2"), []byte("/V 3 /R 2"), 1)
+	d, err := Open(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("unsupported encryption stopped Open: %s", err)
+	}
+	if _, err := d.Resolve(Ref{Num: 1}); !errors.Is(err, ErrEncrypted) || !strings.Contains(err.Error(), "/V 3") {
+		t.Fatalf("want ErrEncrypted with the reason, got %v", err)
+	}
+	if err := d.Unlock("owner"); err == nil || errors.Is(err, ErrBadPassword) {
+		t.Fatalf("want unsupported encryption from Unlock, got %v", err)
+	}
+}
+
+func TestCryptBadKeyLength(t *testing.T) {
+	e := encryptDict(cryptCase{"AES-40", 4, 4, 40, "AESV2"}, "", "owner")
+	o, err := NewObjectParser(NewLexer("", e)).ParseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCrypt(o.(Dict), testID, ""); err == nil {
+		t.Fatalf("failed to detect 40 bit AESV2 key")
+	}
+	c := &Crypt{key: make([]byte, 10)}
+	if _, err := c.decrypt(1, 0, methodAESV3, make([]byte, 32)); err == nil {
+		t.Fatalf("failed to detect bad AES key in decrypt")
+	}
+	if _, err := c.encrypt(1, 0, methodAESV3, []byte("data")); err == nil {
+		t.Fatalf("failed to detect bad AES key in encrypt")
+	}
+}
+
+func TestCryptRoundTrip(t *testing.T) {
+	for _, c := range cryptCases {
+		d, err := Open(bytes.NewReader(encryptedPDF(t, c, "", "owner")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		o, err := d.Resolve(Ref{Num: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc, err := d.Crypt.Encrypt(3, 0, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := d.Crypt.Decrypt(3, 0, enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec.(Stream).Raw, o.(Stream).Raw) {
+			t.Fatalf("%s: stream didn't round trip", c.name)
+		}
+		if bytes.Equal(enc.(Stream).Raw, o.(Stream).Raw) {
+			t.Fatalf("%s: stream wasn't encrypted", c.name)
+		}
+	}
+}
+
+func TestCryptStreamMethod(t *testing.T) {
+	c := &Crypt{stm: methodAESV2, crypt: map[string]cryptMethod{"Identity": methodIdentity}}
+	for _, tt := range []struct {
+		dict string
+		meta bool
+		want cryptMethod
+	}{
+		{"<< /Filter /FlateDecode >>", true, methodAESV2},
+		{"<< /Filter [/Crypt /FlateDecode] /DecodeParms [<< /Name /Identity >> null] >>", true, methodIdentity},
+		{"<< /Filter /Crypt >>", true, methodIdentity},
+		{"<< /Type /Metadata /Subtype /XML >>", true, methodAESV2},
+		{"<< /Type /Metadata /Subtype /XML >>", false, methodIdentity},
+	} {
+		o, err := NewObjectParser(NewLexer("", tt.dict)).ParseObject()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.meta = tt.meta
+		if m, err := c.streamMethod(o.(Dict)); err != nil || m != tt.want {
+			t.Fatalf("%s: want method %d, got %d %v", tt.dict, tt.want, m, err)
+		}
+	}
+	if _, err := c.streamMethod(Dict{Entries: []DictEntry{
+		{Name{Value: "Filter"}, Name{Value: "Crypt"}},
+		{Name{Value: "DecodeParms"}, Dict{Entries: []DictEntry{{Name{Value: "Name"}, Name{Value: "Missing"}}}}},
+	}}); err == nil {
+		t.Fatalf("failed to detect missing crypt filter")
+	}
+
+	x := Stream{Dict: Dict{Entries: []DictEntry{{Name{Value: "Type"}, Name{Value: "XRef"}}}}, Raw: []byte("rows")}
+	if o, err := c.Decrypt(1, 0, x); err != nil || string(o.(Stream).Raw) != "rows" {
+		t.Fatalf("xref stream was decrypted: %v", err)
+	}
+}
+
+func TestCryptHashR6(t *testing.T) {
+	// Computed independently from the description of Algorithm 2.B
+	c := &Crypt{R: 6}
+	for _, tt := range []struct {
+		pw, salt, u, want string
+	}{
+		{"secret", "12345678", "", "837d62471967d2da1dcc72639b3337133ad178cdffcc7b6a85fe341ea825f9ca"},
+		{"owner", "abcdefgh", strings.Repeat("0123456789", 5)[:48], "bbde570aa41335f6e934909363c67eedc2f12b756bae3570b0b1d873f84f83ee"},
+	} {
+		var u []byte
+		if tt.u != "" {
+			u = []byte(tt.u)
+		}
+		if got := hex.EncodeToString(c.hash([]byte(tt.pw), []byte(tt.salt), u)); got != tt.want {
+			t.Fatalf("want %s, got %s", tt.want, got)
+		}
+	}
+}
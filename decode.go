@@ -0,0 +1,229 @@
+package pdflex
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Name decodes an ItemName, returning the name without its leading solidus
+// and with any #XX escapes replaced by the bytes they stand for.
+// cf PDF3200_2008.pdf 7.3.5
+func (i Item) Name() (string, error) {
+	if i.Typ != ItemName || !strings.HasPrefix(i.Val, "/") {
+		return "", i.decodeErrorf(ErrBadName, "not a name")
+	}
+	s := i.Val[1:]
+	if strings.IndexByte(s, '#') < 0 {
+		return s, nil
+	}
+	var b []byte
+	for j := 0; j < len(s); j++ {
+		if s[j] != '#' {
+			b = append(b, s[j])
+			continue
+		}
+		if j+2 >= len(s) {
+			return "", i.decodeErrorf(ErrBadName, "truncated escape %q", s[j:])
+		}
+		c, err := hex.DecodeString(s[j+1 : j+3])
+		if err != nil {
+			return "", i.decodeErrorf(ErrBadName, "bad escape %q", s[j:j+3])
+		}
+		if c[0] == 0 {
+			return "", i.decodeErrorf(ErrBadName, "escaped NUL in name")
+		}
+		b = append(b, c[0])
+		j += 2
+	}
+	return string(b), nil
+}
+
+// Bytes decodes an ItemString or ItemHexString. Literal strings have their
+// escapes processed and their line breaks normalised to LF, and hex strings
+// with an odd number of digits are padded with a final 0.
+// cf PDF3200_2008.pdf 7.3.4.2, 7.3.4.3
+func (i Item) Bytes() ([]byte, error) {
+	switch {
+	case i.Typ == ItemString && len(i.Val) >= 2 && i.Val[0] == '(' && i.Val[len(i.Val)-1] == ')':
+		return i.literal(i.Val[1 : len(i.Val)-1])
+	case i.Typ == ItemHexString && len(i.Val) >= 2 && i.Val[0] == '<' && i.Val[len(i.Val)-1] == '>':
+		return i.hex(i.Val[1 : len(i.Val)-1])
+	}
+	return nil, i.decodeErrorf(ErrBadString, "not a string")
+}
+
+func (i Item) literal(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	balance := 0
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch c {
+		case '(':
+			balance++
+		case ')':
+			if balance--; balance < 0 {
+				return nil, i.decodeErrorf(ErrBadString, "unbalanced parentheses")
+			}
+		case '\r':
+			// CR and CRLF both mean LF
+			if j+1 < len(s) && s[j+1] == '\n' {
+				j++
+			}
+			c = '\n'
+		case '\\':
+			if j++; j == len(s) {
+				return nil, i.decodeErrorf(ErrBadString, "unterminated escape")
+			}
+			switch c = s[j]; c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// line continuation
+				if j+1 < len(s) && s[j+1] == '\n' {
+					j++
+				}
+				continue
+			case '\n':
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// up to three octal digits, high-order overflow is ignored
+				n := 0
+				for k := 0; k < 3 && j < len(s) && '0' <= s[j] && s[j] <= '7'; k++ {
+					n = n<<3 | int(s[j]-'0')
+					j++
+				}
+				j--
+				c = byte(n)
+			default:
+				// includes \( \) and \\, for anything else the backslash
+				// is ignored
+			}
+		}
+		b = append(b, c)
+	}
+	if balance != 0 {
+		return nil, i.decodeErrorf(ErrBadString, "unbalanced parentheses")
+	}
+	return b, nil
+}
+
+func (i Item) hex(s string) ([]byte, error) {
+	digits := make([]byte, 0, len(s)+1)
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case isWhiteByte(rune(c)):
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+			digits = append(digits, c)
+		default:
+			return nil, i.decodeErrorf(ErrBadHexString, "illegal character in hexstring: %#U", rune(c))
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b := make([]byte, len(digits)/2)
+	_, err := hex.Decode(b, digits)
+	return b, err
+}
+
+// spellName is the reverse of Name. It returns the name with a leading
+// solidus, and with #XX escapes for delimiters, '#' and anything that isn't
+// printable ASCII.
+func spellName(name string) string {
+	var sb strings.Builder
+	sb.WriteByte('/')
+	for j := 0; j < len(name); j++ {
+		c := name[j]
+		if c <= ' ' || c > '~' || c == '#' || strings.IndexByte("()<>[]{}/%", c) >= 0 {
+			fmt.Fprintf(&sb, "#%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// spellString is the reverse of Bytes. It returns a hex string, or a literal
+// string with the delimiters, backslash and any unprintable bytes escaped, so
+// the spelling survives line ending conversion.
+func spellString(b []byte, isHex bool) string {
+	if isHex {
+		return "<" + hex.EncodeToString(b) + ">"
+	}
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for _, c := range b {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03o", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte(')')
+	return sb.String()
+}
+
+// Int decodes an ItemNumber which is an integer.
+// cf PDF3200_2008.pdf 7.3.3
+func (i Item) Int() (int64, error) {
+	if i.Typ != ItemNumber || !isNumber(i.Val) || strings.IndexByte(i.Val, '.') >= 0 {
+		return 0, i.decodeErrorf(ErrBadNumber, "not an integer")
+	}
+	n, err := strconv.ParseInt(i.Val, 10, 64)
+	if err != nil {
+		return 0, i.decodeErrorf(ErrBadNumber, "integer out of range")
+	}
+	return n, nil
+}
+
+// Float decodes any ItemNumber.
+// cf PDF3200_2008.pdf 7.3.3
+func (i Item) Float() (float64, error) {
+	if i.Typ != ItemNumber || !isNumber(i.Val) {
+		return 0, i.decodeErrorf(ErrBadNumber, "not a number")
+	}
+	f, err := strconv.ParseFloat(i.Val, 64)
+	if err != nil {
+		return 0, i.decodeErrorf(ErrBadNumber, "number out of range")
+	}
+	return f, nil
+}
+
+// isNumber checks the syntax of a PDF number more strictly than strconv,
+// which would also allow exponents, hex, Inf and so on.
+func isNumber(s string) bool {
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		s = s[1:]
+	}
+	digits, dots := 0, 0
+	for j := 0; j < len(s); j++ {
+		switch {
+		case '0' <= s[j] && s[j] <= '9':
+			digits++
+		case s[j] == '.':
+			dots++
+		default:
+			return false
+		}
+	}
+	return digits > 0 && dots <= 1
+}
+
+func (i Item) decodeErrorf(kind error, format string, args ...interface{}) error {
+	return newError(kind, i, "can't decode %v %q: %s", i.Typ, i.Val, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,133 @@
+package pdflex
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestName(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"/Name1", "Name1", true},
+		{"/", "", true},
+		{"/A;Name_With-Various***Characters?", "A;Name_With-Various***Characters?", true},
+		{"/Lime#20Green", "Lime Green", true},
+		{"/paired#28#29parentheses", "paired()parentheses", true},
+		{"/The_Key_of_F#23_Minor", "The_Key_of_F#_Minor", true},
+		{"/A#42", "AB", true},
+		{"/caf#e9", "caf\xe9", true},
+		{"/A#4", "", false},
+		{"/A#", "", false},
+		{"/A#GG", "", false},
+		{"/A#00", "", false},
+		{"A", "", false},
+	} {
+		got, err := Item{Typ: ItemName, Val: tc.in}.Name()
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Fatalf("%q: want %q, %v got %q, %v", tc.in, tc.want, tc.ok, got, err)
+		}
+	}
+	if _, err := (Item{Typ: ItemWord, Val: "/A"}).Name(); err == nil {
+		t.Fatalf("failed to reject non-name item")
+	}
+}
+
+func TestBytes(t *testing.T) {
+	for _, tc := range []struct {
+		typ      ItemType
+		in, want string
+		ok       bool
+	}{
+		{ItemString, "(This is a string)", "This is a string", true},
+		{ItemString, "()", "", true},
+		{ItemString, "(Strings may contain balanced parentheses ( ) and\nspecial characters (*!&}^% and so on).)",
+			"Strings may contain balanced parentheses ( ) and\nspecial characters (*!&}^% and so on).", true},
+		{ItemString, `(\n\r\t\b\f\(\)\\)`, "\n\r\t\b\f()\\", true},
+		{ItemString, "(a\\\nb\\\r\nc\\\rd)", "abcd", true},
+		{ItemString, "(a\rb\r\nc\nd)", "a\nb\nc\nd", true},
+		{ItemString, `(\0053\053\53\5x\1234)`, "\x053++\x05xS4", true},
+		{ItemString, `(\777)`, "\xff", true},
+		{ItemString, `(\q)`, "q", true},
+		{ItemString, `(a\)`, "", false},
+		{ItemString, `(a(b)`, "", false},
+		{ItemString, `(a)b)`, "", false},
+		{ItemString, `a`, "", false},
+		{ItemHexString, "<4E6F762073686D6F7A206B6120706F702E>", "Nov shmoz ka pop.", true},
+		{ItemHexString, "<901FA3>", "\x90\x1f\xa3", true},
+		{ItemHexString, "<901FA>", "\x90\x1f\xa0", true},
+		{ItemHexString, "< 90 1f\r\na >", "\x90\x1f\xa0", true},
+		{ItemHexString, "<>", "", true},
+		{ItemHexString, "<9G>", "", false},
+		{ItemHexString, "<90", "", false},
+		{ItemName, "/A", "", false},
+	} {
+		got, err := Item{Typ: tc.typ, Val: tc.in}.Bytes()
+		if (err == nil) != tc.ok || !bytes.Equal(got, []byte(tc.want)) {
+			t.Fatalf("%q: want %q, %v got %q, %v", tc.in, tc.want, tc.ok, got, err)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		i   int64
+		iok bool
+		f   float64
+		fok bool
+	}{
+		{"123", 123, true, 123, true},
+		{"43445", 43445, true, 43445, true},
+		{"+17", 17, true, 17, true},
+		{"-98", -98, true, -98, true},
+		{"0", 0, true, 0, true},
+		{"34.5", 0, false, 34.5, true},
+		{"-3.62", 0, false, -3.62, true},
+		{"+123.6", 0, false, 123.6, true},
+		{"4.", 0, false, 4, true},
+		{"-.002", 0, false, -0.002, true},
+		{"0.0", 0, false, 0, true},
+		{"+", 0, false, 0, false},
+		{".", 0, false, 0, false},
+		{"1e5", 0, false, 0, false},
+		{"--5", 0, false, 0, false},
+		{"1.2.3", 0, false, 0, false},
+		{"99999999999999999999", 0, false, 1e20, true},
+	} {
+		it := Item{Typ: ItemNumber, Val: tc.in}
+		i, err := it.Int()
+		if (err == nil) != tc.iok || i != tc.i {
+			t.Fatalf("%q: want int %d, %v got %d, %v", tc.in, tc.i, tc.iok, i, err)
+		}
+		f, err := it.Float()
+		if (err == nil) != tc.fok || f != tc.f {
+			t.Fatalf("%q: want float %g, %v got %g, %v", tc.in, tc.f, tc.fok, f, err)
+		}
+	}
+}
+
+func TestDecodeLexed(t *testing.T) {
+	l := NewLexer("test", `/Lime#20Green (a\(b) <414> -.5`)
+	var got []interface{}
+	for i := range l.Items() {
+		switch i.Typ {
+		case ItemName:
+			s, _ := i.Name()
+			got = append(got, s)
+		case ItemString, ItemHexString:
+			b, _ := i.Bytes()
+			got = append(got, string(b))
+		case ItemNumber:
+			f, _ := i.Float()
+			got = append(got, f)
+		}
+	}
+	want := []interface{}{"Lime Green", "a(b", "A@", -0.5}
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("want %#v, got %#v", want, got)
+		}
+	}
+}
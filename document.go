@@ -0,0 +1,407 @@
+package pdflex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Spec: 7.5.4 - 7.5.5
+// A conforming reader starts at the end of the file, reads the offset after
+// the last startxref keyword, and finds the cross-reference table and trailer
+// there. The table maps object numbers to byte offsets, so any object can be
+// read without parsing the whole file.
+//
+// Spec: 7.5.6
+// Incremental updates append objects, a new xref section and a new trailer
+// to the file. The new trailer's /Prev gives the offset of the previous
+// section, and entries in later sections override earlier ones. Hybrid files
+// (7.5.8.4) also have an /XRefStm in the trailer, pointing to an xref stream
+// with extra entries for readers that understand them.
+
+// tailSize is how far from the end of the file to look for startxref. The
+// spec says %%EOF should be in the last 1024 bytes, this leaves some slack
+// for trailing junk.
+const tailSize = 2048
+
+// Document is a PDF file opened for random access through its xref table.
+type Document struct {
+	Name      string      // used only for error reports
+	Xref      map[int]Row // merged xref entries of every revision, by object number
+	Trailer   Dict        // the trailer of the last revision
+	StartXref int         // the offset given after the last startxref keyword
+	Revisions []Revision  // oldest first
+	Crypt     *Crypt      // set once an encrypted document is unlocked
+	cryptErr  error       // why the encryption can't be handled, if it can't
+	r         io.ReaderAt
+	size      int64
+	objStms   map[int]*ObjectStream // decoded object streams by object number
+}
+
+// Open reads the xref table and trailer of the PDF in r. The size of the input
+// is taken from a Size or Stat method, so r is usually an *os.File, a
+// *bytes.Reader or a *strings.Reader.
+func Open(r io.ReaderAt) (*Document, error) {
+	d := &Document{r: r, Xref: make(map[int]Row), objStms: make(map[int]*ObjectStream)}
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		d.size = v.Size()
+	case interface{ Stat() (os.FileInfo, error) }:
+		fi, err := v.Stat()
+		if err != nil {
+			return nil, err
+		}
+		d.size = fi.Size()
+		if f, ok := v.(*os.File); ok {
+			d.Name = f.Name()
+		}
+	default:
+		return nil, fmt.Errorf("can't find the size of a %T", r)
+	}
+
+	off, err := d.findStartXref()
+	if err != nil {
+		return nil, err
+	}
+	d.StartXref = off
+
+	// Follow the /Prev chain back to the original file
+	seen := make(map[int]bool)
+	for {
+		if seen[off] {
+			return nil, fmt.Errorf("%s: /Prev loop at pos %d", d.Name, off)
+		}
+		seen[off] = true
+		rev, err := d.readXref(off)
+		if err != nil {
+			return nil, err
+		}
+		d.Revisions = append([]Revision{rev}, d.Revisions...)
+		prev, ok := rev.Trailer.Get("Prev").(Number)
+		if !ok {
+			break
+		}
+		if !prev.IsInt || prev.Int < 0 || prev.Int >= d.size {
+			return nil, fmt.Errorf("%s: invalid /Prev at pos %d", d.Name, prev.Span().Start)
+		}
+		off = int(prev.Int)
+	}
+
+	for _, rev := range d.Revisions {
+		for num, r := range rev.Xref {
+			d.Xref[num] = r
+		}
+	}
+	d.Trailer = d.Revisions[len(d.Revisions)-1].Trailer
+
+	// Most encrypted files only have an owner password. Encryption that
+	// can't be handled at all is reported by Resolve, the rest of the
+	// document can still be read.
+	if d.Encrypted() {
+		c, err := d.newCrypt("")
+		if err != nil && !errors.Is(err, ErrBadPassword) {
+			d.cryptErr = err
+		}
+		d.Crypt = c
+	}
+	return d, nil
+}
+
+// Encrypted reports whether the trailer has an /Encrypt entry.
+func (d *Document) Encrypted() bool {
+	return d.Trailer.Get("Encrypt") != nil
+}
+
+// Unlock sets up decryption of an encrypted document with password, which
+// can be the user or owner password. Open has already tried the empty user
+// password. Until the document is unlocked, Resolve returns ErrEncrypted,
+// along with the reason if Open found encryption it can't handle.
+func (d *Document) Unlock(password string) error {
+	c, err := d.newCrypt(password)
+	if err != nil {
+		return err
+	}
+	d.Crypt, d.cryptErr = c, nil
+	return nil
+}
+
+// newCrypt reads the /Encrypt dict and authenticates password against it.
+func (d *Document) newCrypt(password string) (*Crypt, error) {
+	var e Dict
+	switch v := d.Trailer.Get("Encrypt").(type) {
+	case Dict:
+		e = v
+	case Ref:
+		o, err := d.resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if e, ok = o.(Dict); !ok {
+			return nil, fmt.Errorf("%s: /Encrypt is not a dict", d.Name)
+		}
+	default:
+		return nil, fmt.Errorf("%s: not encrypted", d.Name)
+	}
+	var id []byte
+	if a, ok := d.Trailer.Get("ID").(Array); ok && len(a.Elems) > 0 {
+		if s, ok := a.Elems[0].(String); ok {
+			id = s.Value
+		}
+	}
+	c, err := NewCrypt(e, id, password)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.Name, err)
+	}
+	return c, nil
+}
+
+// Revision is one xref section and its trailer, which is what an incremental
+// update adds to a file. Xref only has the entries from this section.
+type Revision struct {
+	Offset  int // of the xref keyword, or the xref stream object
+	Xref    map[int]Row
+	Trailer Dict
+	Stream  bool // the xref is a stream, not a table
+}
+
+// parserAt returns an ObjectParser reading from offset off to the end of the
+// input. Positions of the objects it returns are offsets in the whole file.
+func (d *Document) parserAt(off int) *ObjectParser {
+	sr := io.NewSectionReader(d.r, int64(off), d.size-int64(off))
+	return NewObjectParser(newLexerAt(d.Name, sr, Pos(off)))
+}
+
+// findStartXref returns the offset after the last startxref keyword.
+func (d *Document) findStartXref() (int, error) {
+	tail := int64(tailSize)
+	if tail > d.size {
+		tail = d.size
+	}
+	buf := make([]byte, tail)
+	if _, err := d.r.ReadAt(buf, d.size-tail); err != nil && err != io.EOF {
+		return 0, err
+	}
+	idx := bytes.LastIndex(buf, []byte("startxref"))
+	if idx < 0 {
+		return 0, fmt.Errorf("%s: no startxref in the last %d bytes", d.Name, tail)
+	}
+	p := d.parserAt(int(d.size-tail) + idx)
+	p.next()
+	o, err := p.ParseObject()
+	if err != nil {
+		return 0, err
+	}
+	n, ok := o.(Number)
+	if !ok || !n.IsInt || n.Int < 0 || n.Int >= d.size {
+		return 0, fmt.Errorf("%s: invalid startxref offset at pos %d", d.Name, o.Span().Start)
+	}
+	return int(n.Int), nil
+}
+
+// readXref parses the xref table at off, and the trailer that follows it, or
+// the xref stream at off. If a trailer has an /XRefStm, the entries in that
+// stream are added to the revision where the table has no entry, and in use
+// entries replace free ones in the table.
+func (d *Document) readXref(off int) (Revision, error) {
+	rev := Revision{Offset: off, Xref: make(map[int]Row)}
+	p := d.parserAt(off)
+	if p.peek(0).Typ != ItemXref {
+		rev.Stream = true
+		return rev, d.readXrefStream(p, off, &rev)
+	}
+	p.next()
+	for {
+		o, err := p.ParseObject()
+		if err != nil {
+			return rev, err
+		}
+		if k, ok := o.(Keyword); ok && k.Value == "trailer" {
+			break
+		}
+		first, ok := o.(Number)
+		if !ok || !first.IsInt || first.Int < 0 {
+			return rev, fmt.Errorf("%s: invalid xref subsection header at pos %d", d.Name, o.Span().Start)
+		}
+		count, err := p.xrefNumber()
+		if err != nil {
+			return rev, err
+		}
+		for j := int64(0); j < count; j++ {
+			r, err := p.xrefRow()
+			if err != nil {
+				return rev, err
+			}
+			num := int(first.Int + j)
+			if _, seen := rev.Xref[num]; !seen {
+				rev.Xref[num] = r
+			}
+		}
+	}
+	o, err := p.ParseObject()
+	if err != nil {
+		return rev, err
+	}
+	t, ok := o.(Dict)
+	if !ok {
+		return rev, fmt.Errorf("%s: trailer at pos %d is not a dict", d.Name, o.Span().Start)
+	}
+	rev.Trailer = t
+
+	if n, ok := t.Get("XRefStm").(Number); ok {
+		if !n.IsInt || n.Int < 0 || n.Int >= d.size {
+			return rev, fmt.Errorf("%s: invalid /XRefStm at pos %d", d.Name, n.Span().Start)
+		}
+		hidden := Revision{Xref: make(map[int]Row)}
+		if err := d.readXrefStream(d.parserAt(int(n.Int)), int(n.Int), &hidden); err != nil {
+			return rev, err
+		}
+		for num, r := range hidden.Xref {
+			if old, ok := rev.Xref[num]; !ok || (!old.Active && r.Active) {
+				rev.Xref[num] = r
+			}
+		}
+	}
+	return rev, nil
+}
+
+// readXrefStream parses the xref stream object at off into rev. Its dict
+// doubles as the trailer.
+func (d *Document) readXrefStream(p *ObjectParser, off int, rev *Revision) error {
+	o, err := p.Next()
+	if err != nil {
+		return err
+	}
+	obj, _ := o.(IndirectObject)
+	s, ok := obj.Value.(Stream)
+	if !ok || !isXrefStream(s) {
+		return fmt.Errorf("%s: no xref table or stream at pos %d", d.Name, off)
+	}
+	x, err := newXrefStream(s.Dict)
+	if err != nil {
+		return fmt.Errorf("%s: %s at pos %d", d.Name, err, off)
+	}
+	entries, err := x.decode(s.Raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s at pos %d", d.Name, err, off)
+	}
+	for _, e := range entries {
+		r, ok := e.row()
+		if _, seen := rev.Xref[e.num]; ok && !seen {
+			rev.Xref[e.num] = r
+		}
+	}
+	rev.Trailer = s.Dict
+	return nil
+}
+
+// xrefNumber parses a non-negative integer in an xref table.
+func (p *ObjectParser) xrefNumber() (int64, error) {
+	i := p.next()
+	n, err := i.Int()
+	if err != nil || n < 0 {
+		return 0, p.errorf(ErrCorruptRow, i, "invalid xref number %q", i.Val)
+	}
+	return n, nil
+}
+
+// xrefRow parses one offset generation n|f entry of an xref table. The fixed
+// width layout isn't enforced here, Parser.FindRow does that.
+func (p *ObjectParser) xrefRow() (Row, error) {
+	off, err := p.xrefNumber()
+	if err != nil {
+		return Row{}, err
+	}
+	gen, err := p.xrefNumber()
+	if err != nil {
+		return Row{}, err
+	}
+	i := p.next()
+	if i.Typ != ItemWord || (i.Val != "n" && i.Val != "f") {
+		return Row{}, p.errorf(ErrCorruptRow, i, "invalid xref entry type %q", i.Val)
+	}
+	return Row{Offset: int(off), Generation: int(gen), Active: i.Val == "n"}, nil
+}
+
+// Resolve reads the object that ref points to. Following the spec, a
+// reference to a free or missing object, or one with the wrong generation, is
+// the null object. Objects stored in an object stream have Spans relative to
+// the decoded stream data, not the file. Strings and streams in an encrypted
+// document are decrypted, and their Spans are still those of the encrypted
+// originals.
+func (d *Document) Resolve(ref Ref) (Object, error) {
+	r, ok := d.Xref[ref.Num]
+	if !ok || !r.Active || r.Generation != ref.Gen {
+		return Null{}, nil
+	}
+	if r.Compressed {
+		// the object stream was decrypted as a whole
+		return d.resolveCompressed(ref, r)
+	}
+	o, err := d.resolve(ref)
+	if err != nil || !d.Encrypted() {
+		return o, err
+	}
+	if e, ok := d.Trailer.Get("Encrypt").(Ref); ok && e.Num == ref.Num {
+		return o, nil
+	}
+	if d.Crypt == nil && d.cryptErr != nil {
+		return nil, fmt.Errorf("%w: object %d %d: %w", d.cryptErr, ref.Num, ref.Gen, ErrEncrypted)
+	}
+	if d.Crypt == nil {
+		return nil, fmt.Errorf("%s: object %d %d: %w", d.Name, ref.Num, ref.Gen, ErrEncrypted)
+	}
+	if o, err = d.Crypt.Decrypt(ref.Num, ref.Gen, o); err != nil {
+		return nil, fmt.Errorf("%s: object %d %d: %s", d.Name, ref.Num, ref.Gen, err)
+	}
+	return o, nil
+}
+
+// resolve reads the uncompressed object that ref points to, as it is in the
+// file.
+func (d *Document) resolve(ref Ref) (Object, error) {
+	r := d.Xref[ref.Num]
+	if r.Offset < 0 || int64(r.Offset) >= d.size {
+		return nil, fmt.Errorf("%s: object %d %d has invalid offset %d", d.Name, ref.Num, ref.Gen, r.Offset)
+	}
+	p := d.parserAt(r.Offset)
+	o, err := p.Next()
+	if err != nil {
+		return nil, err
+	}
+	obj, ok := o.(IndirectObject)
+	if !ok || obj.Num != ref.Num || obj.Gen != ref.Gen {
+		return nil, fmt.Errorf("%s: no object %d %d at pos %d", d.Name, ref.Num, ref.Gen, r.Offset)
+	}
+	return obj.Value, nil
+}
+
+// resolveCompressed finds the object for ref in the object stream given by
+// its xref row r. Decoded object streams are cached.
+func (d *Document) resolveCompressed(ref Ref, r Row) (Object, error) {
+	st, ok := d.objStms[r.Stream]
+	if !ok {
+		if d.Xref[r.Stream].Compressed {
+			return nil, fmt.Errorf("%s: object stream %d is itself compressed", d.Name, r.Stream)
+		}
+		o, err := d.Resolve(Ref{Num: r.Stream})
+		if err != nil {
+			return nil, err
+		}
+		s, ok := o.(Stream)
+		if !ok {
+			return nil, fmt.Errorf("%s: object %d is in object %d, which is not a stream", d.Name, ref.Num, r.Stream)
+		}
+		if st, err = DecodeObjectStream(s); err != nil {
+			return nil, fmt.Errorf("%s: object stream %d: %s", d.Name, r.Stream, err)
+		}
+		d.objStms[r.Stream] = st
+	}
+	obj, ok := st.Object(ref.Num, r.Index)
+	if !ok {
+		return nil, fmt.Errorf("%s: no object %d in object stream %d", d.Name, ref.Num, r.Stream)
+	}
+	return obj.Value, nil
+}
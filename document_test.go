@@ -0,0 +1,182 @@
+package pdflex
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	d, err := Open(strings.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.StartXref != 565 {
+		t.Fatalf("want startxref 565, got %d", d.StartXref)
+	}
+	if len(d.Xref) != 5 {
+		t.Fatalf("want 5 xref entries, got %d", len(d.Xref))
+	}
+	if r := d.Xref[0]; r.Active || r.Generation != 65535 {
+		t.Fatalf("bad free entry %#v", r)
+	}
+	if r := d.Xref[3]; !r.Active || r.Offset != 178 {
+		t.Fatalf("bad entry for object 3 %#v", r)
+	}
+
+	root, err := d.Resolve(d.Trailer.Get("Root").(Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat := root.(Dict)
+	if cat.Get("Type").(Name).Value != "Catalog" {
+		t.Fatalf("bad catalog %#v", cat)
+	}
+	if s := cat.Span(); pdf[s.Start:s.End] != "<< /Type /Catalog\n     /Pages 2 0 R\n  >>" {
+		t.Fatalf("bad catalog span %q", pdf[s.Start:s.End])
+	}
+
+	pages, err := d.Resolve(cat.Get("Pages").(Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid := pages.(Dict).Get("Kids").(Array).Elems[0].(Ref)
+	page, err := d.Resolve(kid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, err := d.Resolve(page.(Dict).Get("Contents").(Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := contents.(Stream)
+	if pdf[s.Body.Start:s.Body.End] != string(s.Raw) {
+		t.Fatalf("stream body span doesn't match Raw")
+	}
+
+	for _, ref := range []Ref{{Num: 0}, {Num: 1, Gen: 1}, {Num: 99}} {
+		o, err := d.Resolve(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := o.(Null); !ok {
+			t.Fatalf("want null for %d %d R, got %#v", ref.Num, ref.Gen, o)
+		}
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	f, err := os.CreateTemp("", "pdflex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.WriteString(pdf); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != f.Name() || d.Trailer.Get("Root") == nil {
+		t.Fatalf("bad document %#v", d)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"%PDF-1.1\n%%EOF\n",
+		"%PDF-1.1\nstartxref\nxyzzy\n%%EOF\n",
+		"%PDF-1.1\nstartxref\n999\n%%EOF\n",
+		"%PDF-1.1\nstartxref\n0\n%%EOF\n",
+		"xref\n0 2\n0000000000 65535 f \ntrailer\n<< >>\nstartxref\n0\n%%EOF\n",
+		"xref\n0 1\n0000000000 65535 f \ntrailer\n[]\nstartxref\n0\n%%EOF\n",
+	} {
+		if _, err := Open(strings.NewReader(in)); err == nil {
+			t.Fatalf("failed to detect error in %q", in)
+		}
+	}
+}
+
+func TestResolveBadOffset(t *testing.T) {
+	in := strings.Replace(pdf, "0000000077 00000 n", "0000000078 00000 n", 1)
+	d, err := Open(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Resolve(Ref{Num: 2}); err == nil {
+		t.Fatalf("failed to detect bad offset")
+	}
+}
+
+// update appends an incremental update to in, replacing object 4 and adding
+// object 5.
+func update(in string) string {
+	var b strings.Builder
+	b.WriteString(in)
+	four := b.Len()
+	b.WriteString("4 0 obj\n<< /Length 5 >>\nstream\nhello\nendstream\nendobj\n")
+	five := b.Len()
+	b.WriteString("5 0 obj\n(five)\nendobj\n")
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 1\n0000000000 65535 f \n4 2\n%.10d 00000 n \n%.10d 00000 n \n", four, five)
+	fmt.Fprintf(&b, "trailer\n<< /Size 6 /Root 1 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", strings.LastIndex(in, "xref\n0"), xref)
+	return b.String()
+}
+
+func TestRevisions(t *testing.T) {
+	in := update(pdf)
+	d, err := Open(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Revisions) != 2 {
+		t.Fatalf("want 2 revisions, got %d", len(d.Revisions))
+	}
+	first, second := d.Revisions[0], d.Revisions[1]
+	if first.Offset != 565 || len(first.Xref) != 5 || first.Stream {
+		t.Fatalf("bad first revision at %d with %d entries", first.Offset, len(first.Xref))
+	}
+	if second.Offset != d.StartXref || len(second.Xref) != 3 {
+		t.Fatalf("bad second revision at %d with %d entries", second.Offset, len(second.Xref))
+	}
+	if second.Trailer.Get("Prev") == nil || first.Trailer.Get("Prev") != nil {
+		t.Fatalf("trailers are in the wrong order")
+	}
+	if len(d.Xref) != 6 || d.Xref[4] != second.Xref[4] || d.Xref[3] != first.Xref[3] {
+		t.Fatalf("revisions were merged incorrectly %#v", d.Xref)
+	}
+
+	o, err := d.Resolve(Ref{Num: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(o.(Stream).Raw) != "hello" {
+		t.Fatalf("got the old object 4 %q", o.(Stream).Raw)
+	}
+	if o, err = d.Resolve(Ref{Num: 5}); err != nil || string(o.(String).Value) != "five" {
+		t.Fatalf("bad object 5 %#v %v", o, err)
+	}
+}
+
+func TestRevisionErrors(t *testing.T) {
+	in := update(pdf)
+	for _, r := range []struct{ old, new string }{
+		{"/Prev 565", "/Prev 99999"},
+		{"/Prev 565", "/Prev -1"},
+		{"/Prev 565", "/Prev 18"},
+	} {
+		if _, err := Open(strings.NewReader(strings.Replace(in, r.old, r.new, 1))); err == nil {
+			t.Fatalf("failed to detect error with %s", r.new)
+		}
+	}
+	// a loop
+	xref := strings.LastIndex(in, "xref\n0")
+	loop := strings.Replace(in, "/Prev 565", fmt.Sprintf("/Prev %d", xref), 1)
+	if _, err := Open(strings.NewReader(loop)); err == nil {
+		t.Fatalf("failed to detect /Prev loop")
+	}
+}
@@ -0,0 +1,63 @@
+package pdflex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds. Every *Error returned by the Lexer, Parser, ObjectParser or
+// the Item decoding methods has one of these as its Kind, so failures can be
+// classified with errors.Is instead of matching on message text.
+var (
+	ErrRead               = errors.New("read error")
+	ErrIllegalChar        = errors.New("illegal character")
+	ErrIllegalNameChar    = errors.New("illegal character in name")
+	ErrUnterminatedString = errors.New("unterminated string")
+	ErrBadHexString       = errors.New("bad hex string")
+	ErrBadNumber          = errors.New("bad number")
+	ErrUnbalanced         = errors.New("unbalanced array, dict or brace")
+	ErrBadStream          = errors.New("bad stream")
+	ErrBadInlineImage     = errors.New("bad inline image")
+	ErrBadName            = errors.New("bad name")
+	ErrBadString          = errors.New("bad string")
+	ErrSyntax             = errors.New("syntax error")
+	ErrCorruptRow         = errors.New("corrupt xref row")
+	ErrParserState        = errors.New("invalid parser state")
+)
+
+// Error describes a problem with an Item. Line and Col are only known for
+// items that came straight from a Lexer, otherwise they are 0.
+type Error struct {
+	Kind error  // one of the Err kinds above
+	Name string // the name of the input, if known
+	Pos  Pos
+	Line int
+	Col  int
+	Item Item // the offending item, or for ErrParserState the last one read
+	Msg  string
+}
+
+func newError(kind error, i Item, format string, args ...interface{}) *Error {
+	return &Error{
+		Kind: kind,
+		Pos:  i.Pos,
+		Line: i.Line,
+		Col:  i.Col,
+		Item: i,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *Error) Error() string {
+	where := fmt.Sprintf("%d:%d", e.Line, e.Col)
+	if e.Line == 0 {
+		where = fmt.Sprintf("pos %d", e.Pos)
+	}
+	if e.Name != "" {
+		where = e.Name + ":" + where
+	}
+	return where + ": " + e.Msg
+}
+
+// Unwrap returns the Kind, so errors.Is(err, ErrBadNumber) works.
+func (e *Error) Unwrap() error { return e.Kind }
@@ -0,0 +1,101 @@
+package pdflex
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLexerErrors(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		kind error
+	}{
+		{"(abc", ErrUnterminatedString},
+		{"<414", ErrUnterminatedString},
+		{"<41 zz>", ErrBadHexString},
+		{"/a\x00b", ErrIllegalNameChar},
+		{"1.2.3", ErrBadNumber},
+		{"<< /A 1 ]", ErrUnbalanced},
+		{"[ 1 2", ErrUnbalanced},
+		{"<< /A 1", ErrUnbalanced},
+		{"}", ErrUnbalanced},
+		{"\x00", ErrIllegalChar},
+		{"<< >>\nstream x", ErrBadStream},
+	} {
+		l := NewLexer("test", tc.in)
+		items := collect(l)
+		err := l.Err()
+		if !errors.Is(err, tc.kind) {
+			t.Fatalf("%q: want %v, got %v", tc.in, tc.kind, err)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Name != "test" || e.Line == 0 {
+			t.Fatalf("%q: bad error %#v", tc.in, err)
+		}
+		var found bool
+		for _, i := range items {
+			if i.Typ == ItemError && i.Pos == e.Pos && i.Val == e.Msg {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("%q: no ItemError matching %v", tc.in, err)
+		}
+	}
+	l := NewLexer("test", pdf)
+	collect(l)
+	if l.Err() != nil || len(l.Errors()) != 0 {
+		t.Fatalf("unexpected error %v", l.Err())
+	}
+}
+
+func TestRecoverErrors(t *testing.T) {
+	l := NewLexer("test", "(a) ] /b\n>> (c")
+	l.SetMode(Recover)
+	collect(l)
+	errs := l.Errors()
+	if len(errs) != 3 {
+		t.Fatalf("want 3 errors, got %d", len(errs))
+	}
+	for j, kind := range []error{ErrUnbalanced, ErrUnbalanced, ErrUnterminatedString} {
+		if !errors.Is(errs[j], kind) {
+			t.Fatalf("error %d: want %v, got %v", j, kind, errs[j])
+		}
+	}
+	if errs[1].Line != 2 {
+		t.Fatalf("want error on line 2, got %s", errs[1])
+	}
+}
+
+func TestObjectParserErrorKinds(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		kind error
+	}{
+		{"(abc", ErrUnterminatedString},
+		{"<< 1 2 >>", ErrSyntax},
+		{"[ 1 obj ]", ErrSyntax},
+		{"/a#zz", ErrBadName},
+	} {
+		_, err := NewObjectParser(NewLexer("test", tc.in)).ParseObject()
+		if !errors.Is(err, tc.kind) {
+			t.Fatalf("%q: want %v, got %v", tc.in, tc.kind, err)
+		}
+		var e *Error
+		if !errors.As(err, &e) || e.Name != "test" {
+			t.Fatalf("%q: bad error %#v", tc.in, err)
+		}
+	}
+}
+
+func TestDecodeErrorKinds(t *testing.T) {
+	if _, err := (Item{Typ: ItemNumber, Val: "1.5"}).Int(); !errors.Is(err, ErrBadNumber) {
+		t.Fatalf("want ErrBadNumber, got %v", err)
+	}
+	if _, err := (Item{Typ: ItemString, Val: "(a\\"}).Bytes(); !errors.Is(err, ErrBadString) {
+		t.Fatalf("want ErrBadString, got %v", err)
+	}
+	if _, err := (Item{Typ: ItemWord, Val: "a"}).Name(); !errors.Is(err, ErrBadName) {
+		t.Fatalf("want ErrBadName, got %v", err)
+	}
+}
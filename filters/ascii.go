@@ -0,0 +1,86 @@
+package filters
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/hex"
+)
+
+// Spec: 7.4.2 - 7.4.3
+// ASCIIHexDecode is pairs of hex digits ending with >, and ASCII85Decode is
+// base-85 ending with ~>. Both ignore whitespace. A final odd hex digit is
+// taken as if followed by 0.
+
+// lineLen is where encoded ASCII output is wrapped.
+const lineLen = 64
+
+func isWhite(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
+
+func decodeASCIIHex(in []byte, _ Params) ([]byte, error) {
+	digits := make([]byte, 0, len(in))
+	for _, c := range in {
+		if c == '>' {
+			break
+		}
+		if !isWhite(c) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 != 0 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	if _, err := hex.Decode(out, digits); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func encodeASCIIHex(in []byte, _ Params) ([]byte, error) {
+	enc := hex.EncodeToString(in)
+	var b bytes.Buffer
+	for len(enc) > lineLen {
+		b.WriteString(enc[:lineLen])
+		b.WriteByte('\n')
+		enc = enc[lineLen:]
+	}
+	b.WriteString(enc)
+	b.WriteByte('>')
+	return b.Bytes(), nil
+}
+
+func decodeASCII85(in []byte, _ Params) ([]byte, error) {
+	in = bytes.TrimLeft(in, "\x00\t\n\f\r ")
+	in = bytes.TrimPrefix(in, []byte("<~"))
+	if idx := bytes.Index(in, []byte("~>")); idx >= 0 {
+		in = in[:idx]
+	} else if idx := bytes.IndexByte(in, '~'); idx >= 0 {
+		in = in[:idx]
+	}
+	out := make([]byte, 4*len(in))
+	n, _, err := ascii85.Decode(out, in, true)
+	if err != nil {
+		return nil, err
+	}
+	return out[:n], nil
+}
+
+func encodeASCII85(in []byte, _ Params) ([]byte, error) {
+	enc := make([]byte, ascii85.MaxEncodedLen(len(in)))
+	enc = enc[:ascii85.Encode(enc, in)]
+	var b bytes.Buffer
+	for len(enc) > lineLen {
+		b.Write(enc[:lineLen])
+		b.WriteByte('\n')
+		enc = enc[lineLen:]
+	}
+	b.Write(enc)
+	b.WriteString("~>")
+	return b.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+// Package filters implements the standard PDF stream filters, 7.4, that
+// don't need an image codec: FlateDecode, LZWDecode, ASCIIHexDecode,
+// ASCII85Decode and RunLengthDecode, along with the predictors that Flate and
+// LZW can use. Each filter can both decode and encode, so a stream can be
+// decoded, modified, and encoded again with the same filter chain.
+//
+// The package knows nothing about PDF objects. Callers turn a stream's
+// /Filter and /DecodeParms into a chain of Filters themselves.
+package filters
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupported is returned for filters this package doesn't implement,
+// like DCTDecode, and for unsupported parameters.
+var ErrUnsupported = errors.New("unsupported")
+
+// Params holds the integer entries of a filter's /DecodeParms dict, by key
+// without the leading slash, eg "Predictor". Missing keys take the default
+// from the spec.
+type Params map[string]int
+
+// Get returns the value of key, or def if it isn't set.
+func (p Params) Get(key string, def int) int {
+	if v, ok := p[key]; ok {
+		return v
+	}
+	return def
+}
+
+// Filter is one stage in a stream's filter chain.
+type Filter struct {
+	Name   string // without the leading slash, eg "FlateDecode"
+	Params Params // may be nil
+}
+
+type codec struct {
+	decode func(in []byte, p Params) ([]byte, error)
+	encode func(in []byte, p Params) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	"FlateDecode":     {decodeFlate, encodeFlate},
+	"LZWDecode":       {decodeLZW, encodeLZW},
+	"ASCIIHexDecode":  {decodeASCIIHex, encodeASCIIHex},
+	"ASCII85Decode":   {decodeASCII85, encodeASCII85},
+	"RunLengthDecode": {decodeRunLength, encodeRunLength},
+	// Crypt, 7.4.10, is done by the security handler before decoding
+	"Crypt": {identity, identity},
+}
+
+// abbreviations are the short names allowed in inline images, 8.9.7
+var abbreviations = map[string]string{
+	"Fl":  "FlateDecode",
+	"LZW": "LZWDecode",
+	"AHx": "ASCIIHexDecode",
+	"A85": "ASCII85Decode",
+	"RL":  "RunLengthDecode",
+}
+
+func identity(in []byte, p Params) ([]byte, error) {
+	return in, nil
+}
+
+func lookup(name string) (codec, error) {
+	if long, ok := abbreviations[name]; ok {
+		name = long
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return codec{}, fmt.Errorf("%w filter %s", ErrUnsupported, name)
+	}
+	return c, nil
+}
+
+// Supported reports whether the named filter, which may be an inline image
+// abbreviation, is implemented.
+func Supported(name string) bool {
+	_, err := lookup(name)
+	return err == nil
+}
+
+// Decode applies each filter in chain to data, in order, which is how a
+// reader decodes a stream. If a filter can only decode part of its input,
+// like FlateDecode on truncated data, the rest of the chain is applied to
+// that part, and the result is returned along with the first error.
+func Decode(data []byte, chain []Filter) ([]byte, error) {
+	var first error
+	for _, f := range chain {
+		c, err := lookup(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = c.decode(data, f.Params); err != nil {
+			err = fmt.Errorf("%s: %w", f.Name, err)
+			if data == nil {
+				return nil, err
+			}
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return data, first
+}
+
+// Encode is the reverse of Decode. It applies the encoders in reverse order,
+// so that Decode(Encode(data, chain), chain) gives back data.
+func Encode(data []byte, chain []Filter) ([]byte, error) {
+	for j := len(chain) - 1; j >= 0; j-- {
+		f := chain[j]
+		c, err := lookup(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = c.encode(data, f.Params); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return data, nil
+}
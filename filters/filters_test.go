@@ -0,0 +1,124 @@
+package filters
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// samples are inputs that every filter must round trip.
+func samples() [][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 20000)
+	r.Read(random)
+	return [][]byte{
+		{},
+		{0},
+		[]byte("a"),
+		[]byte("-----A---B"),
+		bytes.Repeat([]byte("ab"), 5000),
+		bytes.Repeat([]byte{0}, 300),
+		[]byte("BT /F1 12 Tf 72 712 Td (A stream with some text) Tj ET\n"),
+		random,
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name := range codecs {
+		chain := []Filter{{Name: name}}
+		for j, in := range samples() {
+			enc, err := Encode(in, chain)
+			if err != nil {
+				t.Fatalf("%s: sample %d: %s", name, j, err)
+			}
+			out, err := Decode(enc, chain)
+			if err != nil {
+				t.Fatalf("%s: sample %d: %s", name, j, err)
+			}
+			if !bytes.Equal(in, out) {
+				t.Fatalf("%s: sample %d didn't round trip", name, j)
+			}
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	chain := []Filter{
+		{Name: "ASCII85Decode"},
+		{Name: "FlateDecode", Params: Params{"Predictor": 12, "Columns": 4}},
+	}
+	in := bytes.Repeat([]byte{1, 2, 3, 4, 1, 2, 3, 5}, 50)
+	enc, err := Encode(in, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(enc, []byte("~>")) {
+		t.Fatalf("outermost filter wasn't ASCII85: %q", enc)
+	}
+	out, err := Decode(enc, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in, out) {
+		t.Fatalf("chain didn't round trip")
+	}
+	// Abbreviated names from inline images work too
+	if out, err := Decode(enc, []Filter{{Name: "A85"}, chain[1]}); err != nil || !bytes.Equal(in, out) {
+		t.Fatalf("abbreviated chain failed: %v", err)
+	}
+}
+
+func TestFlateTruncated(t *testing.T) {
+	in := samples()[7][:2000]
+	chain := []Filter{{Name: "FlateDecode"}}
+	enc, err := Encode(in, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := Decode(enc[:len(enc)/2], chain)
+	if err == nil {
+		t.Fatalf("failed to detect truncated data")
+	}
+	if len(out) == 0 || !bytes.HasPrefix(in, out) {
+		t.Fatalf("want a prefix of the input, got %d bytes", len(out))
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if _, err := Decode([]byte("x"), []Filter{{Name: "DCTDecode"}}); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("want ErrUnsupported, got %v", err)
+	}
+	if Supported("JBIG2Decode") || !Supported("RL") {
+		t.Fatalf("Supported is wrong")
+	}
+}
+
+func TestASCIIHex(t *testing.T) {
+	out, err := Decode([]byte("61 62\n6>junk"), []Filter{{Name: "ASCIIHexDecode"}})
+	if err != nil || string(out) != "ab`" {
+		t.Fatalf("want \"ab`\", got %q %v", out, err)
+	}
+	if _, err := Decode([]byte("6x>"), []Filter{{Name: "ASCIIHexDecode"}}); err == nil {
+		t.Fatalf("failed to detect bad hex digit")
+	}
+}
+
+func TestASCII85(t *testing.T) {
+	out, err := Decode([]byte("<~9jqo^\nz~>"), []Filter{{Name: "ASCII85Decode"}})
+	if err != nil || string(out) != "Man \x00\x00\x00\x00" {
+		t.Fatalf("bad decode %q %v", out, err)
+	}
+}
+
+func TestRunLength(t *testing.T) {
+	out, err := Decode([]byte{2, 'a', 'b', 'c', 254, 'x', 128, 'j'}, []Filter{{Name: "RunLengthDecode"}})
+	if err != nil || string(out) != "abcxxx" {
+		t.Fatalf("bad decode %q %v", out, err)
+	}
+	for _, in := range [][]byte{{5, 'a'}, {200}} {
+		if _, err := Decode(in, []Filter{{Name: "RunLengthDecode"}}); err == nil {
+			t.Fatalf("failed to detect truncated run in %v", in)
+		}
+	}
+}
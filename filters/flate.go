@@ -0,0 +1,49 @@
+package filters
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+)
+
+// Spec: 7.4.4
+// FlateDecode is zlib (RFC 1950), optionally with a predictor applied to the
+// data before compression.
+
+// decodeFlate returns what it could inflate along with the error when the
+// data is truncated or corrupt part way through.
+func decodeFlate(in []byte, p Params) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		if len(data) == 0 {
+			return nil, err
+		}
+		out, perr := unpredict(data, p)
+		if perr != nil {
+			return nil, err
+		}
+		return out, err
+	}
+	return unpredict(data, p)
+}
+
+func encodeFlate(in []byte, p Params) ([]byte, error) {
+	data, err := predict(in, p)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,186 @@
+package filters
+
+import "fmt"
+
+// Spec: 7.4.4.2
+// LZWDecode uses variable width codes of 9 to 12 bits, packed high bit
+// first. 256 clears the table and 257 is end of data. With /EarlyChange 1,
+// the default, the code width goes up one code earlier than it strictly
+// needs to, which is what TIFF does, and why compress/lzw can't be used.
+
+const (
+	lzwClear = 256
+	lzwEOD   = 257
+	lzwFirst = 258 // first code added to the table
+	lzwMax   = 4096
+)
+
+// lzwWidth is the code width used when the table has next entries.
+func lzwWidth(next, early int) int {
+	switch n := next + early; {
+	case n < 512:
+		return 9
+	case n < 1024:
+		return 10
+	case n < 2048:
+		return 11
+	}
+	return 12
+}
+
+func lzwEarly(p Params) (int, error) {
+	early := p.Get("EarlyChange", 1)
+	if early != 0 && early != 1 {
+		return 0, fmt.Errorf("invalid /EarlyChange %d", early)
+	}
+	return early, nil
+}
+
+func decodeLZW(in []byte, p Params) ([]byte, error) {
+	early, err := lzwEarly(p)
+	if err != nil {
+		return nil, err
+	}
+	var out []byte
+	table := make([][]byte, lzwFirst, lzwMax)
+	for j := 0; j < 256; j++ {
+		table[j] = []byte{byte(j)}
+	}
+	var bits uint32
+	var nbits int
+	prev := -1
+	for len(in) > 0 || nbits > 0 {
+		width := lzwWidth(len(table), early)
+		for nbits < width && len(in) > 0 {
+			bits = bits<<8 | uint32(in[0])
+			in = in[1:]
+			nbits += 8
+		}
+		if nbits < width {
+			// Trailing padding bits, and no EOD. Plenty of files do this.
+			break
+		}
+		code := int(bits>>uint(nbits-width)) & (1<<uint(width) - 1)
+		nbits -= width
+
+		switch {
+		case code == lzwClear:
+			table = table[:lzwFirst]
+			prev = -1
+			continue
+		case code == lzwEOD:
+			return unpredict(out, p)
+		case prev < 0:
+			if code > 255 {
+				return nil, fmt.Errorf("invalid first code %d", code)
+			}
+			out = append(out, byte(code))
+			prev = code
+			continue
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+		case code == len(table):
+			entry = append(table[prev][:len(table[prev]):len(table[prev])], table[prev][0])
+		default:
+			return nil, fmt.Errorf("invalid code %d", code)
+		}
+		out = append(out, entry...)
+		if len(table) < lzwMax {
+			old := table[prev]
+			add := make([]byte, len(old)+1)
+			copy(add, old)
+			add[len(old)] = entry[0]
+			table = append(table, add)
+		}
+		prev = code
+	}
+	return unpredict(out, p)
+}
+
+// lzwWriter packs codes high bit first.
+type lzwWriter struct {
+	out   []byte
+	bits  uint32
+	nbits int
+}
+
+func (w *lzwWriter) write(code, width int) {
+	w.bits = w.bits<<uint(width) | uint32(code)
+	w.nbits += width
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.bits>>uint(w.nbits-8)))
+		w.nbits -= 8
+	}
+}
+
+func (w *lzwWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.bits<<uint(8-w.nbits)))
+		w.nbits = 0
+	}
+	return w.out
+}
+
+func encodeLZW(in []byte, p Params) ([]byte, error) {
+	early, err := lzwEarly(p)
+	if err != nil {
+		return nil, err
+	}
+	if in, err = predict(in, p); err != nil {
+		return nil, err
+	}
+
+	// The decoder's table lags one entry behind ours, because it can only
+	// add an entry once it has seen the first byte of the next code. Code
+	// widths have to follow the decoder's table size, which is dnext.
+	var w lzwWriter
+	type key struct {
+		prefix int
+		b      byte
+	}
+	var dict map[key]int
+	var next, dnext int
+	first := true
+	reset := func() {
+		dict = make(map[key]int)
+		next, dnext, first = lzwFirst, lzwFirst, true
+	}
+	emit := func(code int) {
+		w.write(code, lzwWidth(dnext, early))
+		if !first {
+			dnext++
+		}
+		first = false
+	}
+
+	reset()
+	w.write(lzwClear, 9)
+	cur := -1
+	for _, b := range in {
+		if cur < 0 {
+			cur = int(b)
+			continue
+		}
+		if code, ok := dict[key{cur, b}]; ok {
+			cur = code
+			continue
+		}
+		emit(cur)
+		dict[key{cur, b}] = next
+		next++
+		cur = int(b)
+		if next == lzwMax {
+			w.write(lzwClear, lzwWidth(dnext, early))
+			reset()
+		}
+	}
+	if cur >= 0 {
+		emit(cur)
+	}
+	w.write(lzwEOD, lzwWidth(dnext, early))
+	return w.flush(), nil
+}
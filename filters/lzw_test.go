@@ -0,0 +1,55 @@
+package filters
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLZWSpecExample(t *testing.T) {
+	// 7.4.4.2 Example 2
+	enc := []byte{0x80, 0x0B, 0x60, 0x50, 0x22, 0x0C, 0x0C, 0x85, 0x01}
+	out, err := Decode(enc, []Filter{{Name: "LZWDecode"}})
+	if err != nil || string(out) != "-----A---B" {
+		t.Fatalf("want %q, got %q %v", "-----A---B", out, err)
+	}
+	got, err := Encode(out, []Filter{{Name: "LZWDecode"}})
+	if err != nil || !bytes.Equal(got, enc) {
+		t.Fatalf("want % x, got % x %v", enc, got, err)
+	}
+}
+
+func TestLZWEarlyChange(t *testing.T) {
+	// Enough distinct pairs to go through every code width and a table reset
+	var in []byte
+	for j := 0; j < 3*lzwMax; j++ {
+		in = append(in, byte(j), byte(j*7), byte(j>>8))
+	}
+	late := []Filter{{Name: "LZWDecode", Params: Params{"EarlyChange": 0}}}
+	early := []Filter{{Name: "LZWDecode"}}
+	enc, err := Encode(in, late)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := Decode(enc, late); err != nil || !bytes.Equal(in, out) {
+		t.Fatalf("EarlyChange 0 didn't round trip: %v", err)
+	}
+	if out, err := Decode(enc, early); err == nil && bytes.Equal(in, out) {
+		t.Fatalf("EarlyChange 0 data decoded with EarlyChange 1")
+	}
+	bad := []Filter{{Name: "LZWDecode", Params: Params{"EarlyChange": 2}}}
+	if _, err := Decode(enc, bad); err == nil {
+		t.Fatalf("failed to detect invalid /EarlyChange")
+	}
+}
+
+func TestLZWNoEOD(t *testing.T) {
+	enc, err := Encode([]byte("hello hello hello"), []Filter{{Name: "LZWDecode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chop off the EOD code, and the partial byte it shares
+	out, err := Decode(enc[:len(enc)-2], []Filter{{Name: "LZWDecode"}})
+	if err != nil || !bytes.HasPrefix([]byte("hello hello hello"), out) || len(out) < 10 {
+		t.Fatalf("bad decode without EOD %q %v", out, err)
+	}
+}
@@ -0,0 +1,268 @@
+package filters
+
+import "fmt"
+
+// Spec: 7.4.4.4
+// Flate and LZW data can have a predictor applied before compression, given
+// by /Predictor in the /DecodeParms. 1 is no prediction and 2 is TIFF
+// Predictor 2, where each component is stored as the difference from the
+// same component of the pixel to its left. 10 and up are the PNG predictors,
+// where each row is prefixed by the PNG filter type used for that row, so a
+// decoder doesn't care which of 10-15 it was. Rows are /Columns pixels of
+// /Colors components of /BitsPerComponent bits, padded to a whole byte.
+
+// layout is the shape of predicted data, from the /DecodeParms.
+type layout struct {
+	predictor int
+	colors    int
+	bpc       int
+	columns   int
+}
+
+func newLayout(p Params) (layout, error) {
+	l := layout{
+		predictor: p.Get("Predictor", 1),
+		colors:    p.Get("Colors", 1),
+		bpc:       p.Get("BitsPerComponent", 8),
+		columns:   p.Get("Columns", 1),
+	}
+	switch {
+	case l.predictor != 1 && l.predictor != 2 && (l.predictor < 10 || l.predictor > 15):
+		return l, fmt.Errorf("%w predictor %d", ErrUnsupported, l.predictor)
+	case l.colors < 1 || l.colors > 32:
+		return l, fmt.Errorf("invalid /Colors %d", l.colors)
+	case l.bpc != 1 && l.bpc != 2 && l.bpc != 4 && l.bpc != 8 && l.bpc != 16:
+		return l, fmt.Errorf("invalid /BitsPerComponent %d", l.bpc)
+	case l.columns < 1 || l.columns > 1<<24:
+		return l, fmt.Errorf("invalid /Columns %d", l.columns)
+	}
+	return l, nil
+}
+
+// rowLen is the number of bytes in one row of decoded data.
+func (l layout) rowLen() int {
+	return (l.colors*l.bpc*l.columns + 7) / 8
+}
+
+// bpp is the distance in bytes to the corresponding byte of the previous
+// pixel, which is what the PNG filters use. It is at least 1.
+func (l layout) bpp() int {
+	return (l.colors*l.bpc + 7) / 8
+}
+
+// RowLen returns the length of one row of decoded data for the predictor
+// given in p, or 1 if there is no predictor or p is invalid. Predicted data
+// can only be cut at a multiple of this without breaking the last row.
+func RowLen(p Params) int {
+	l, err := newLayout(p)
+	if err != nil || l.predictor == 1 {
+		return 1
+	}
+	return l.rowLen()
+}
+
+// unpredict reverses the predictor given in p.
+func unpredict(data []byte, p Params) ([]byte, error) {
+	l, err := newLayout(p)
+	if err != nil {
+		return nil, err
+	}
+	switch l.predictor {
+	case 1:
+		return data, nil
+	case 2:
+		return l.unpredictTIFF(data)
+	}
+	return unpredictPNG(data, l.rowLen(), l.bpp())
+}
+
+// predict applies the predictor given in p. A final partial row is padded
+// with zeros.
+func predict(data []byte, p Params) ([]byte, error) {
+	l, err := newLayout(p)
+	if err != nil {
+		return nil, err
+	}
+	switch l.predictor {
+	case 1:
+		return data, nil
+	case 2:
+		return l.predictTIFF(data), nil
+	}
+	return predictPNG(data, l.rowLen(), l.bpp(), l.predictor), nil
+}
+
+// component returns component i of a row of bpc bit components.
+func component(row []byte, i, bpc int) int {
+	switch bpc {
+	case 8:
+		return int(row[i])
+	case 16:
+		return int(row[2*i])<<8 | int(row[2*i+1])
+	}
+	bit := i * bpc
+	shift := uint(8 - bpc - bit%8)
+	return int(row[bit/8]>>shift) & (1<<uint(bpc) - 1)
+}
+
+// setComponent sets component i of a row of bpc bit components to v, which
+// is truncated to bpc bits.
+func setComponent(row []byte, i, bpc, v int) {
+	switch bpc {
+	case 8:
+		row[i] = byte(v)
+		return
+	case 16:
+		row[2*i], row[2*i+1] = byte(v>>8), byte(v)
+		return
+	}
+	bit := i * bpc
+	shift := uint(8 - bpc - bit%8)
+	mask := byte(1<<uint(bpc)-1) << shift
+	row[bit/8] = row[bit/8]&^mask | byte(v)<<shift&mask
+}
+
+// unpredictTIFF reverses TIFF Predictor 2.
+func (l layout) unpredictTIFF(in []byte) ([]byte, error) {
+	rowLen := l.rowLen()
+	if len(in)%rowLen != 0 {
+		return nil, fmt.Errorf("predicted data is not a whole number of rows")
+	}
+	out := append([]byte(nil), in...)
+	n := l.colors * l.columns
+	for row := out; len(row) > 0; row = row[rowLen:] {
+		for i := l.colors; i < n; i++ {
+			setComponent(row, i, l.bpc, component(row, i, l.bpc)+component(row, i-l.colors, l.bpc))
+		}
+	}
+	return out, nil
+}
+
+// predictTIFF applies TIFF Predictor 2.
+func (l layout) predictTIFF(in []byte) []byte {
+	rowLen := l.rowLen()
+	out := append([]byte(nil), in...)
+	if pad := len(out) % rowLen; pad != 0 {
+		out = append(out, make([]byte, rowLen-pad)...)
+	}
+	n := l.colors * l.columns
+	for row := out; len(row) > 0; row = row[rowLen:] {
+		// right to left, so the left neighbour is still the original value
+		for i := n - 1; i >= l.colors; i-- {
+			setComponent(row, i, l.bpc, component(row, i, l.bpc)-component(row, i-l.colors, l.bpc))
+		}
+	}
+	return out
+}
+
+// unpredictPNG reverses PNG prediction of rows of rowLen bytes, with bpp
+// bytes per pixel. Each row is prefixed by its PNG filter type. Plenty of
+// producers leave padding or a short row at the end, which is ignored.
+func unpredictPNG(in []byte, rowLen, bpp int) ([]byte, error) {
+	in = in[:len(in)-len(in)%(rowLen+1)]
+	out := make([]byte, 0, len(in)/(rowLen+1)*rowLen)
+	prev := make([]byte, rowLen)
+	for ; len(in) > 0; in = in[rowLen+1:] {
+		tag, row := in[0], in[1:rowLen+1]
+		cur := make([]byte, rowLen)
+		for j, b := range row {
+			var left, upleft byte
+			if j >= bpp {
+				left, upleft = cur[j-bpp], prev[j-bpp]
+			}
+			up := prev[j]
+			switch tag {
+			case 0:
+			case 1:
+				b += left
+			case 2:
+				b += up
+			case 3:
+				b += byte((int(left) + int(up)) / 2)
+			case 4:
+				b += paeth(left, up, upleft)
+			default:
+				return nil, fmt.Errorf("invalid PNG filter type %d", tag)
+			}
+			cur[j] = b
+		}
+		out = append(out, cur...)
+		prev = cur
+	}
+	return out, nil
+}
+
+// filterPNG applies PNG filter type tag to cur, whose previous row is prev.
+func filterPNG(dst, cur, prev []byte, bpp int, tag byte) {
+	for j, b := range cur {
+		var left, upleft byte
+		if j >= bpp {
+			left, upleft = cur[j-bpp], prev[j-bpp]
+		}
+		up := prev[j]
+		switch tag {
+		case 1:
+			b -= left
+		case 2:
+			b -= up
+		case 3:
+			b -= byte((int(left) + int(up)) / 2)
+		case 4:
+			b -= paeth(left, up, upleft)
+		}
+		dst[j] = b
+	}
+}
+
+// predictPNG applies PNG prediction to rows of rowLen bytes. Predictors 10 to
+// 14 use PNG filter types 0 to 4 for every row. 15, "optimum", picks the
+// filter type for each row with the smallest sum of absolute differences,
+// the same heuristic libpng uses.
+func predictPNG(in []byte, rowLen, bpp, predictor int) []byte {
+	rows := (len(in) + rowLen - 1) / rowLen
+	out := make([]byte, 0, rows*(rowLen+1))
+	prev := make([]byte, rowLen)
+	dst := make([]byte, rowLen)
+	for len(in) > 0 {
+		cur := make([]byte, rowLen)
+		in = in[copy(cur, in):]
+		tag := byte(predictor - 10)
+		if predictor == 15 {
+			best := -1
+			for t := byte(0); t <= 4; t++ {
+				filterPNG(dst, cur, prev, bpp, t)
+				sum := 0
+				for _, b := range dst {
+					sum += abs(int(int8(b)))
+				}
+				if best < 0 || sum < best {
+					best, tag = sum, t
+				}
+			}
+		}
+		filterPNG(dst, cur, prev, bpp, tag)
+		out = append(out, tag)
+		out = append(out, dst...)
+		prev = cur
+	}
+	return out
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
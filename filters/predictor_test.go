@@ -0,0 +1,125 @@
+package filters
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPNGPredictor(t *testing.T) {
+	// Sub, Up, Average and Paeth rows, 3 columns
+	in := []byte{
+		1, 1, 2, 3,
+		2, 1, 1, 1,
+		3, 10, 10, 10,
+		4, 1, 1, 1,
+	}
+	want := []byte{
+		1, 3, 6,
+		2, 4, 7,
+		11, 17, 22,
+		12, 18, 23,
+	}
+	got, err := unpredictPNG(in, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if back, _ := unpredictPNG(predictPNG(want, 3, 1, 12), 3, 1); !bytes.Equal(back, want) {
+		t.Fatalf("predict round trip failed, got %v", back)
+	}
+	if got, err := unpredictPNG(in[:6], 3, 1); err != nil || !bytes.Equal(got, want[:3]) {
+		t.Fatalf("partial row wasn't ignored, got %v %v", got, err)
+	}
+	if _, err := unpredictPNG([]byte{5, 0, 0, 0}, 3, 1); err == nil {
+		t.Fatalf("failed to detect invalid filter type")
+	}
+}
+
+func TestPredictorRoundTrip(t *testing.T) {
+	in := make([]byte, 1200)
+	for j := range in {
+		in[j] = byte(j*j/7 + j%13)
+	}
+	for _, predictor := range []int{2, 10, 11, 12, 13, 14, 15} {
+		for _, shape := range [][3]int{{1, 8, 10}, {3, 8, 10}, {4, 8, 3}, {1, 1, 96}, {3, 2, 8}, {2, 4, 5}, {3, 16, 4}} {
+			p := Params{"Predictor": predictor, "Colors": shape[0], "BitsPerComponent": shape[1], "Columns": shape[2]}
+			for _, name := range []string{"FlateDecode", "LZWDecode"} {
+				chain := []Filter{{Name: name, Params: p}}
+				enc, err := Encode(in, chain)
+				if err != nil {
+					t.Fatalf("%s %v: %s", name, p, err)
+				}
+				out, err := Decode(enc, chain)
+				if err != nil {
+					t.Fatalf("%s %v: %s", name, p, err)
+				}
+				if !bytes.Equal(in, out) {
+					t.Fatalf("%s %v didn't round trip", name, p)
+				}
+			}
+		}
+	}
+}
+
+func TestPNGFilterTypes(t *testing.T) {
+	in := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	for predictor := 10; predictor <= 14; predictor++ {
+		out := predictPNG(in, 4, 1, predictor)
+		for j := 0; j < len(out); j += 5 {
+			if out[j] != byte(predictor-10) {
+				t.Fatalf("predictor %d wrote filter type %d", predictor, out[j])
+			}
+		}
+	}
+	// Every row of a ramp is all 1s with Sub, which is the cheapest
+	out := predictPNG(in, 4, 1, 15)
+	if out[0] != 1 || !bytes.Equal(out[1:5], []byte{1, 1, 1, 1}) {
+		t.Fatalf("optimum picked %v", out[:5])
+	}
+}
+
+func TestTIFFPredictor(t *testing.T) {
+	// Two RGB pixels per row, the second stored as the difference
+	raw := []byte{10, 20, 30, 1, 2, 3, 200, 100, 50, 60, 200, 10}
+	want := []byte{10, 20, 30, 11, 22, 33, 200, 100, 50, 4, 44, 60}
+	l := layout{predictor: 2, colors: 3, bpc: 8, columns: 2}
+	got, err := l.unpredictTIFF(raw)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("want %v, got %v %v", want, got, err)
+	}
+	if back := l.predictTIFF(want); !bytes.Equal(back, raw) {
+		t.Fatalf("want %v, got %v", raw, back)
+	}
+
+	// 4 bit grey, 4 pixels per row: 1 2 3 15 stored as 1 1 1 12
+	l = layout{predictor: 2, colors: 1, bpc: 4, columns: 4}
+	got, err = l.unpredictTIFF([]byte{0x11, 0x1c})
+	if err != nil || !bytes.Equal(got, []byte{0x12, 0x3f}) {
+		t.Fatalf("want [12 3f], got %x %v", got, err)
+	}
+	if _, err := l.unpredictTIFF([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("failed to detect partial row")
+	}
+}
+
+func TestPredictorParams(t *testing.T) {
+	for _, p := range []Params{
+		{"Predictor": 3},
+		{"Predictor": 16},
+		{"Predictor": 12, "Columns": 0},
+		{"Predictor": 12, "Colors": 0},
+		{"Predictor": 2, "BitsPerComponent": 3},
+	} {
+		if _, err := Encode([]byte{1}, []Filter{{Name: "FlateDecode", Params: p}}); err == nil {
+			t.Fatalf("failed to detect invalid %v", p)
+		}
+	}
+	if n := RowLen(Params{"Predictor": 12, "Colors": 3, "BitsPerComponent": 4, "Columns": 5}); n != 8 {
+		t.Fatalf("want row length 8, got %d", n)
+	}
+	if n := RowLen(nil); n != 1 {
+		t.Fatalf("want row length 1, got %d", n)
+	}
+}
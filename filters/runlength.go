@@ -0,0 +1,60 @@
+package filters
+
+import "fmt"
+
+// Spec: 7.4.5
+// RunLengthDecode data is runs, each starting with a length byte. 0 to 127
+// means copy the next length+1 bytes, 129 to 255 means repeat the next byte
+// 257-length times, and 128 is end of data.
+
+func decodeRunLength(in []byte, _ Params) ([]byte, error) {
+	var out []byte
+	for len(in) > 0 {
+		n := int(in[0])
+		in = in[1:]
+		switch {
+		case n == 128:
+			return out, nil
+		case n < 128:
+			if len(in) < n+1 {
+				return nil, fmt.Errorf("literal run of %d bytes is truncated", n+1)
+			}
+			out = append(out, in[:n+1]...)
+			in = in[n+1:]
+		default:
+			if len(in) < 1 {
+				return nil, fmt.Errorf("repeat run is truncated")
+			}
+			for j := 0; j < 257-n; j++ {
+				out = append(out, in[0])
+			}
+			in = in[1:]
+		}
+	}
+	return out, nil
+}
+
+func encodeRunLength(in []byte, _ Params) ([]byte, error) {
+	var out []byte
+	for len(in) > 0 {
+		// length of the run of repeats at the start of in
+		rep := 1
+		for rep < len(in) && rep < 128 && in[rep] == in[0] {
+			rep++
+		}
+		if rep > 1 {
+			out = append(out, byte(257-rep), in[0])
+			in = in[rep:]
+			continue
+		}
+		// literal run, up to the start of the next repeat
+		lit := 1
+		for lit < len(in) && lit < 128 && !(lit+1 < len(in) && in[lit] == in[lit+1]) {
+			lit++
+		}
+		out = append(out, byte(lit-1))
+		out = append(out, in[:lit]...)
+		in = in[lit:]
+	}
+	return append(out, 128), nil
+}
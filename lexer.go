@@ -13,7 +13,11 @@ package pdflex
 
 import (
 	"fmt"
+	"io"
+	"iter"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 	"unicode/utf8"
 )
@@ -22,12 +26,17 @@ type Pos int
 
 // item represents a token or text string returned from the scanner.
 type Item struct {
-	Typ ItemType // The type of this item.
-	Pos          // The starting position, in bytes, of this item in the input string.
-	Val string   // The value of this item.
+	Typ  ItemType // The type of this item.
+	Pos           // The starting position, in bytes, of this item in the input string.
+	Val  string   // The value of this item.
+	Line int      // The line of the start of this item, counting from 1.
+	Col  int      // The byte column of the start of this item, counting from 1.
 }
 
-// itemType identifies the type of lex items.
+// itemType identifies the type of lex items. Its String method returns the
+// name of the constant without the Item prefix, eg "StreamBody".
+//
+//go:generate stringer -type=ItemType -trimprefix=Item
 type ItemType int
 
 const (
@@ -40,12 +49,17 @@ const (
 	ItemRightDict // >> token
 	ItemLeftArray
 	ItemRightArray
-	ItemStreamBody // raw contents of a stream
-	ItemString     // PDF Literal String 7.3.4.2
-	ItemHexString  // PDF Hex String 7.3.4.3
-	ItemComment    // 7.2.3
-	ItemName       // PDF Name Object 7.3.5
-	ItemWord       // catchall for an unrecognised blob of alnums
+	ItemStreamBody      // raw contents of a stream
+	ItemString          // PDF Literal String 7.3.4.2
+	ItemHexString       // PDF Hex String 7.3.4.3
+	ItemComment         // 7.2.3
+	ItemName            // PDF Name Object 7.3.5
+	ItemWord            // catchall for an unrecognised blob of alnums
+	ItemInvalid         // input skipped after an error in Recover mode
+	ItemOperator        // content stream operator, Annex A
+	ItemInlineImageData // raw data of an inline image, between ID and EI 8.9.7
+	ItemLeftBrace       // PostScript calculator { 7.10.5
+	ItemRightBrace
 	// Keywords appear after all the rest.
 	ItemKeyword // used only to delimit the keywords
 	ItemObj     // just the obj and endobj markers
@@ -60,6 +74,33 @@ const (
 	ItemNull
 )
 
+// itemTypes maps the names returned by ItemType.String back to the ItemType
+var itemTypes = func() map[string]ItemType {
+	m := make(map[string]ItemType)
+	for t := ItemType(0); t < ItemType(len(_ItemType_index)-1); t++ {
+		m[t.String()] = t
+	}
+	return m
+}()
+
+// ParseItemType is the inverse of ItemType.String. It also accepts the full
+// constant name, eg "ItemStreamBody".
+func ParseItemType(s string) (ItemType, error) {
+	if t, ok := itemTypes[strings.TrimPrefix(s, "Item")]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown item type %q", s)
+}
+
+// GoString returns the name of the constant, so that %#v formats items as
+// valid Go.
+func (i ItemType) GoString() string {
+	if _, ok := itemTypes[i.String()]; ok {
+		return "pdflex.Item" + i.String()
+	}
+	return "pdflex." + i.String()
+}
+
 // If they need to be used directly in code then a constant string is easiest
 const (
 	leftDict    = "<<"
@@ -82,37 +123,170 @@ var keytoks = map[string]ItemType{
 	"null":      ItemNull,
 }
 
+// operators is the set of content stream operators
+// cf PDF3200_2008.pdf Annex A Table A.1
+var operators = map[string]bool{
+	"b": true, "B": true, "b*": true, "B*": true, "BDC": true, "BI": true,
+	"BMC": true, "BT": true, "BX": true, "c": true, "cm": true, "CS": true,
+	"cs": true, "d": true, "d0": true, "d1": true, "Do": true, "DP": true,
+	"EI": true, "EMC": true, "ET": true, "EX": true, "f": true, "F": true,
+	"f*": true, "G": true, "g": true, "gs": true, "h": true, "i": true,
+	"ID": true, "j": true, "J": true, "K": true, "k": true, "l": true,
+	"m": true, "M": true, "MP": true, "n": true, "q": true, "Q": true,
+	"re": true, "RG": true, "rg": true, "ri": true, "s": true, "S": true,
+	"SC": true, "sc": true, "SCN": true, "scn": true, "sh": true, "T*": true,
+	"Tc": true, "Td": true, "TD": true, "Tf": true, "Tj": true, "TJ": true,
+	"TL": true, "Tm": true, "Tr": true, "Ts": true, "Tw": true, "Tz": true,
+	"v": true, "w": true, "W": true, "W*": true, "y": true, "'": true,
+	"\"": true,
+}
+
+// Mode is a set of flags controlling optional lexer behaviour.
+type Mode uint
+
+const (
+	// ByteExact lexes the input as bytes rather than UTF-8. Whitespace is
+	// exactly the six characters and delimiters the ten characters of
+	// PDF32000_2008.pdf 7.2.2, and only ASCII letters and digits start a
+	// word. By default the lexer decodes UTF-8 and uses the unicode
+	// package, which differs from the spec for VT, NUL, NEL and NBSP, and
+	// lets non-ASCII letters into words.
+	ByteExact Mode = 1 << iota
+	// Recover carries on after an error instead of ending the scan. The
+	// ItemError is followed by the rest of the offending item, up to the
+	// next delimiter or whitespace, as ItemInvalid, so that every byte of
+	// the input is still returned in some item.
+	Recover
+	// Content lexes a decoded content stream rather than a file. Operators
+	// are emitted as ItemOperator, the data of inline images as
+	// ItemInlineImageData, and file structure keywords like obj and stream
+	// are just words.
+	Content
+)
+
 const lexEOF = -1
 
+// readSize is the minimum number of bytes requested from the underlying reader
+// each time a streaming lexer runs out of buffered input.
+const readSize = 64 * 1024
+
 // stateFn represents the state of the scanner as a function that returns the next state.
 type stateFn func(*Lexer) stateFn
 
 // lexer holds the state of the scanner.
 type Lexer struct {
-	name       string    // the name of the input; used only for error reports
-	input      string    // the string being scanned
-	state      stateFn   // the next lexing function to enter
-	pos        Pos       // current position in the input
-	start      Pos       // start position of this item
-	width      Pos       // width of last rune read from input
-	lastPos    Pos       // position of most recent item returned by nextItem
-	items      chan Item // channel of scanned items
-	arrayDepth int       // nesting depth of [], <<>>
+	name       string        // the name of the input; used only for error reports
+	input      string        // the portion of the input currently held in memory
+	base       Pos           // position of input[0] in the whole input
+	r          io.Reader     // source of further input, nil once exhausted
+	rerr       error         // the first non-EOF error returned by r
+	state      stateFn       // the next lexing function to enter
+	pos        Pos           // current position in the input
+	start      Pos           // start position of this item
+	width      Pos           // width of last rune read from input
+	lastPos    Pos           // position of most recent item returned by nextItem
+	lastLine   int           // line of most recent item returned by nextItem
+	line       int           // line of the start of this item
+	col        int           // column of the start of this item
+	afterCR    bool          // the previous item ended with CR, which might precede LF
+	queue      []Item        // items scanned but not yet returned
+	items      chan Item     // channel of scanned items, used by NextItem
+	done       chan struct{} // closed by Close to stop the NextItem goroutine
+	closeOnce  sync.Once
+	running    bool // NextItem has started the goroutine
+	arrayDepth int  // nesting depth of [], <<>>, {}
 	dictDepth  int
+	braceDepth int
+	mode       Mode  // optional behaviour, fixed once lexing starts
+	started    bool  // the state machine has been started
+	lengths    []int // direct /Length of each open dict, -1 if none seen
+	lengthKey  bool  // the last significant item was a /Length key
+	lengthRef  int   // significant items since the last /Length value
+	streamLen  int   // /Length of the dict just closed, -1 if none
+	// mu guards mismatches and errs, which the NextItem goroutine appends to
+	mu         sync.Mutex
+	mismatches []LengthMismatch
+	errs       []*Error // one for every ItemError emitted
+}
+
+// LengthMismatch records a stream whose direct /Length did not agree with the
+// position of its endstream keyword. The body was cut at the keyword instead.
+type LengthMismatch struct {
+	Pos    Pos // start of the stream body
+	Length int // the /Length value from the stream dictionary
+	Actual int // length of the body up to the endstream keyword
 }
 
 func (l *Lexer) Pos() Pos     { return l.pos }
 func (l *Lexer) Start() Pos   { return l.start }
 func (l *Lexer) Width() Pos   { return l.width }
 func (l *Lexer) LastPos() Pos { return l.lastPos }
+func (l *Lexer) Mode() Mode   { return l.mode }
+
+// LengthMismatches returns every stream seen so far whose /Length was wrong.
+// It is complete once ItemEOF has been read. It is safe to call while the
+// NextItem goroutine is still scanning, but the scan may be further ahead
+// than the items returned so far.
+func (l *Lexer) LengthMismatches() []LengthMismatch {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LengthMismatch(nil), l.mismatches...)
+}
+
+// Errors returns an *Error for every ItemError emitted so far, in order. Like
+// LengthMismatches, it is complete once ItemEOF has been read.
+func (l *Lexer) Errors() []*Error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*Error(nil), l.errs...)
+}
+
+// Err returns the first error emitted, or nil if there were none.
+func (l *Lexer) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.errs) == 0 {
+		return nil
+	}
+	return l.errs[0]
+}
+
+// errorAt returns the error for the ItemError at pos.
+func (l *Lexer) errorAt(pos Pos) (*Error, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for j := len(l.errs) - 1; j >= 0; j-- {
+		if l.errs[j].Pos == pos {
+			return l.errs[j], true
+		}
+	}
+	return nil, false
+}
+
+// SetMode sets the optional behaviour of the lexer. It has no effect once the
+// first item has been read.
+func (l *Lexer) SetMode(m Mode) {
+	if !l.started {
+		l.mode = m
+	}
+}
 
 // next returns the next rune in the input.
 func (l *Lexer) next() rune {
-	if int(l.pos) >= len(l.input) {
+	// Make sure a whole rune is buffered, if there is one.
+	if int(l.pos-l.base)+utf8.UTFMax > len(l.input) {
+		l.fill()
+	}
+	if int(l.pos-l.base) >= len(l.input) {
 		l.width = 0
 		return lexEOF
 	}
-	r, w := utf8.DecodeRuneInString(l.input[l.pos:])
+	if l.mode&ByteExact != 0 {
+		l.width = 1
+		l.pos++
+		return rune(l.input[l.pos-1-l.base])
+	}
+	r, w := utf8.DecodeRuneInString(l.input[l.pos-l.base:])
 	l.width = Pos(w)
 	l.pos += l.width
 	return r
@@ -130,12 +304,115 @@ func (l *Lexer) backup() {
 	l.pos -= l.width
 }
 
+// fill reads more input from the underlying reader, if there is one,
+// discarding everything before the start of the current item. It reports
+// whether any new input was added. The read size grows with the item being
+// scanned so that very large items are still buffered in linear time.
+func (l *Lexer) fill() bool {
+	if l.r == nil {
+		return false
+	}
+	keep := l.input[l.start-l.base:]
+	n := readSize
+	if len(keep) > n {
+		n = len(keep)
+	}
+	buf := make([]byte, len(keep)+n)
+	copy(buf, keep)
+	// Fill the whole buffer so that readers returning short reads don't
+	// cause the retained input to be copied over and over.
+	m, err := io.ReadFull(l.r, buf[len(keep):])
+	buf = buf[:len(keep)+m]
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			l.rerr = err
+		}
+		l.r = nil
+	}
+	l.base = l.start
+	l.input = string(buf)
+	return len(buf) > len(keep)
+}
+
+// current returns the text of the item being scanned.
+func (l *Lexer) current() string {
+	return l.input[l.start-l.base : l.pos-l.base]
+}
+
 // emit passes an item back to the client.
 func (l *Lexer) emit(t ItemType) {
-	l.items <- Item{t, l.start, l.input[l.start:l.pos]}
+	val := l.current()
+	l.trackLength(t, val)
+	l.queue = append(l.queue, l.item(t, val))
+	l.advance(val)
 	l.start = l.pos
 }
 
+// item returns an item starting at the start of the current item.
+func (l *Lexer) item(t ItemType, val string) Item {
+	return Item{Typ: t, Pos: l.start, Val: val, Line: l.line, Col: l.col}
+}
+
+// advance moves the line and column counters past text. CR, LF and CRLF
+// are each one line break, even if the CRLF is split between two items.
+// cf PDF3200_2008.pdf 7.5.1
+func (l *Lexer) advance(text string) {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\r':
+			l.line++
+			l.col = 1
+			l.afterCR = true
+			continue
+		case '\n':
+			if !l.afterCR {
+				l.line++
+				l.col = 1
+			}
+		default:
+			l.col++
+		}
+		l.afterCR = false
+	}
+}
+
+// trackLength follows the /Length key of each dict so that the body of a
+// stream can be cut at its declared length. Only direct integers count, so a
+// value followed by a generation and R is forgotten again.
+func (l *Lexer) trackLength(t ItemType, val string) {
+	switch t {
+	case ItemSpace, ItemEOL, ItemComment:
+		return
+	case ItemStream:
+		// lexStream needs streamLen
+		return
+	}
+	l.lengthRef++
+	top := len(l.lengths) - 1
+	switch {
+	case t == ItemRightDict && top >= 0:
+		l.streamLen = l.lengths[top]
+		l.lengths = l.lengths[:top]
+		l.lengthKey = false
+		return
+	case t == ItemLeftDict:
+		l.lengths = append(l.lengths, -1)
+	case t == ItemName && val == "/Length" && top >= 0:
+		l.lengthKey = true
+		l.streamLen = -1
+		return
+	case t == ItemNumber && l.lengthKey:
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			l.lengths[top] = n
+			l.lengthRef = 0
+		}
+	case t == ItemWord && val == "R" && l.lengthRef == 2 && top >= 0:
+		l.lengths[top] = -1
+	}
+	l.lengthKey = false
+	l.streamLen = -1
+}
+
 // ignore skips over the pending input before this point.
 func (l *Lexer) ignore() {
 	l.start = l.pos
@@ -161,39 +438,166 @@ func (l *Lexer) acceptRun(valid string) {
 // the previous item returned by nextItem. Doing it this way
 // means we don't have to worry about peek double counting.
 func (l *Lexer) LineNumber() int {
-	return 1 + strings.Count(l.input[:l.lastPos], "\n")
+	return l.lastLine
 }
 
 // errorf returns an error token and terminates the scan by passing
 // back a nil pointer that will be the next state, terminating l.nextItem.
-func (l *Lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- Item{ItemError, l.start, fmt.Sprintf(format, args...)}
-	l.items <- Item{ItemEOF, l.start, ""}
+// In Recover mode it passes back lexRecover instead. The error is also kept,
+// with its kind, for Errors.
+func (l *Lexer) errorf(kind error, format string, args ...interface{}) stateFn {
+	i := l.item(ItemError, fmt.Sprintf(format, args...))
+	e := newError(kind, i, "%s", i.Val)
+	e.Name = l.name
+	l.mu.Lock()
+	l.errs = append(l.errs, e)
+	l.mu.Unlock()
+	l.queue = append(l.queue, i)
+	if l.mode&Recover != 0 {
+		return lexRecover
+	}
+	l.queue = append(l.queue, l.item(ItemEOF, ""))
 	return nil
 }
 
-// nextItem returns the next item from the input.
-func (l *Lexer) NextItem() Item {
-	item := <-l.items
+// scan runs the state machine until it has produced an item. Once the
+// machine has stopped it returns ItemEOF forever.
+func (l *Lexer) scan() Item {
+	// NextItem sets started before its goroutine calls scan, so this is only
+	// ever written by the client's goroutine.
+	if !l.started {
+		l.started = true
+	}
+	for len(l.queue) == 0 {
+		if l.state == nil {
+			return l.item(ItemEOF, "")
+		}
+		l.state = l.state(l)
+	}
+	item := l.queue[0]
+	l.queue = l.queue[1:]
+	return item
+}
+
+// returned records the item about to be handed to the client.
+func (l *Lexer) returned(item Item) {
 	l.lastPos = item.Pos
+	l.lastLine = item.Line
+}
+
+// Next returns the next item from the input. It runs the state machine
+// directly, without a goroutine, so it is much cheaper than NextItem and there
+// is nothing to clean up if the client stops early. Next and NextItem should
+// not both be used on the same Lexer.
+func (l *Lexer) Next() Item {
+	item := l.scan()
+	l.returned(item)
+	return item
+}
+
+// Items returns an iterator over the remaining items, as returned by Next,
+// stopping before ItemEOF.
+func (l *Lexer) Items() iter.Seq[Item] {
+	return func(yield func(Item) bool) {
+		for i := l.Next(); i.Typ != ItemEOF; i = l.Next() {
+			if !yield(i) {
+				return
+			}
+		}
+	}
+}
+
+// nextItem returns the next item from the input. The state machine runs
+// ahead in its own goroutine, which lives until ItemEOF has been returned or
+// Close is called.
+func (l *Lexer) NextItem() Item {
+	item := Item{Typ: ItemEOF, Pos: l.lastPos, Line: l.lastLine}
+	select {
+	case <-l.done:
+	default:
+		if !l.running {
+			l.running = true
+			l.started = true
+			go l.run()
+		}
+		if i, ok := <-l.items; ok {
+			item = i
+		}
+	}
+	l.returned(item)
 	return item
 }
 
+// Close stops the goroutine started by NextItem, which otherwise runs until
+// it can deliver ItemEOF. NextItem returns ItemEOF after Close. It is safe to
+// call Close more than once, and from another goroutine.
+func (l *Lexer) Close() {
+	l.closeOnce.Do(func() { close(l.done) })
+}
+
 // NewLexer creates a new scanner for the input string.
 func NewLexer(name, input string) *Lexer {
 	l := &Lexer{
-		name:  name,
-		input: input,
-		items: make(chan Item),
+		name:      name,
+		input:     input,
+		state:     lexDefault,
+		items:     make(chan Item),
+		done:      make(chan struct{}),
+		streamLen: -1,
+		line:      1,
+		col:       1,
+	}
+	return l
+}
+
+// NewContentLexer creates a new scanner for a decoded content stream, in
+// Content mode.
+func NewContentLexer(name, input string) *Lexer {
+	l := NewLexer(name, input)
+	l.SetMode(Content)
+	return l
+}
+
+// NewReaderLexer creates a new scanner that reads its input incrementally
+// from r. Only the item currently being scanned and a bounded read-ahead are
+// held in memory, so the largest single item (usually a stream body) is what
+// limits memory use. Positions are still absolute offsets from the start of r.
+func NewReaderLexer(name string, r io.Reader) *Lexer {
+	l := &Lexer{
+		name:      name,
+		r:         r,
+		state:     lexDefault,
+		items:     make(chan Item),
+		done:      make(chan struct{}),
+		streamLen: -1,
+		line:      1,
+		col:       1,
 	}
-	go l.run()
 	return l
 }
 
-// run runs the state machine for the lexer.
+// newLexerAt creates a scanner reading from r, which starts at offset off in
+// some larger input, so that item positions are offsets in the larger input.
+// Line and column numbers still count from the start of r.
+func newLexerAt(name string, r io.Reader, off Pos) *Lexer {
+	l := NewReaderLexer(name, r)
+	l.base, l.pos, l.start, l.lastPos = off, off, off, off
+	return l
+}
+
+// run runs the state machine for the lexer, passing items to NextItem.
 func (l *Lexer) run() {
-	for l.state = lexDefault; l.state != nil; {
-		l.state = l.state(l)
+	defer close(l.items)
+	for {
+		item := l.scan()
+		select {
+		case l.items <- item:
+		case <-l.done:
+			return
+		}
+		if item.Typ == ItemEOF {
+			return
+		}
 	}
 }
 
@@ -210,7 +614,7 @@ func lexDefault(l *Lexer) stateFn {
 	case r == '\n':
 		l.emit(ItemEOL)
 		return lexDefault
-	case unicode.IsSpace(r):
+	case l.isWhite(r):
 		return lexSpace
 	case r == '/':
 		return lexName
@@ -218,7 +622,7 @@ func lexDefault(l *Lexer) stateFn {
 		l.backup()
 		return lexNumber
 		// strings and hex objects have stricter rules
-	case isAlphaNumeric(r):
+	case l.isAlphaNumeric(r):
 		return lexWord
 	case r == '(':
 		return lexStringObj
@@ -240,67 +644,151 @@ func lexDefault(l *Lexer) stateFn {
 		l.arrayDepth--
 		l.emit(ItemRightArray)
 		if l.arrayDepth < 0 {
-			return l.errorf("unexexpected array terminator")
+			l.arrayDepth = 0
+			return l.errorf(ErrUnbalanced, "unexexpected array terminator")
+		}
+		return lexDefault
+	// Braces only appear in PostScript calculator functions, but they can
+	// nest as well.
+	case r == '{':
+		l.emit(ItemLeftBrace)
+		l.braceDepth++
+		return lexDefault
+	case r == '}':
+		l.braceDepth--
+		l.emit(ItemRightBrace)
+		if l.braceDepth < 0 {
+			l.braceDepth = 0
+			return l.errorf(ErrUnbalanced, "unexpected brace terminator")
 		}
 		return lexDefault
 	case r == '%':
 		return lexComment
+	case (r == '\'' || r == '"') && l.mode&Content != 0:
+		// the only operators that aren't alphanumeric
+		l.emit(ItemOperator)
+		return lexDefault
 	case r == '>':
 		if l.peek() == '>' {
 			l.dictDepth--
 			if l.dictDepth < 0 {
+				l.dictDepth = 0
 				l.next()
 				l.emit(ItemRightDict)
-				return l.errorf("unexexpected dict terminator")
+				return l.errorf(ErrUnbalanced, "unexexpected dict terminator")
 			}
 			l.backup()
 			return lexRightDict
 		}
 		// '>' as part of a hex object should have been consumed in lexHex, so
 		// a stray '>' in this state is not valid.
-		fallthrough
+		return l.errorf(ErrIllegalChar, "illegal character: %#U", r)
 	case r == lexEOF:
+		// Reset everything we complain about, so Recover mode can finish.
+		if err := l.rerr; err != nil {
+			l.rerr = nil
+			return l.errorf(ErrRead, "read error: %s", err)
+		}
 		if l.arrayDepth > 0 {
-			return l.errorf("unterminated array")
+			l.arrayDepth = 0
+			return l.errorf(ErrUnbalanced, "unterminated array")
 		}
 		if l.dictDepth > 0 {
-			return l.errorf("unterminated dict")
+			l.dictDepth = 0
+			return l.errorf(ErrUnbalanced, "unterminated dict")
+		}
+		if l.braceDepth > 0 {
+			l.braceDepth = 0
+			return l.errorf(ErrUnbalanced, "unterminated brace")
 		}
 		l.emit(ItemEOF)
 		return nil
 
 	default:
-		return l.errorf("illegal character: %#U", r)
+		return l.errorf(ErrIllegalChar, "illegal character: %#U", r)
+	}
+}
+
+// lexRecover resynchronises after an error by skipping the rest of the bad
+// item, if one was started, up to the next delimiter or whitespace.
+func lexRecover(l *Lexer) stateFn {
+	if l.pos > l.start {
+		for r := l.peek(); r != lexEOF && !isDelim(r) && !l.isWhite(r); r = l.peek() {
+			l.next()
+		}
+		l.emit(ItemInvalid)
 	}
+	return lexDefault
 }
 
 // lexStream quickly skips over all the contents of PDF stream objects. The
-// 'stream' header has already been consumed and emitted in lexWord.
+// 'stream' header has already been consumed and emitted in lexWord. If the
+// stream dictionary had a direct /Length that ends just before the endstream
+// keyword the body is cut there, otherwise we search for the keyword.
 func lexStream(l *Lexer) stateFn {
 
-	// emit a space token for the space(s) terminating the stream marker
-	if !l.scanEOL() {
-		return l.errorf("expected EOL terminator for stream keyword, got: %#U", l.peek())
+	length := l.streamLen
+	l.streamLen = -1
+
+	// emit a space token for the space(s) terminating the stream marker. If
+	// it's missing and we're recovering, just carry on with the body.
+	if l.scanEOL() {
+		l.emit(ItemEOL)
+	} else if l.errorf(ErrBadStream, "expected EOL terminator for stream keyword, got: %#U", l.peek()) == nil {
+		return nil
+	}
+
+	if length >= 0 && l.atLength(length) {
+		l.pos += Pos(length)
+		l.emit(ItemStreamBody)
+		return lexDefault
 	}
-	l.emit(ItemEOL)
 
-	i := strings.Index(l.input[l.pos:], rightStream)
-	if i < 0 {
-		return l.errorf("unclosed stream")
+	// Streaming lexers might not have the end marker buffered yet. Only new
+	// input needs to be searched after each read, but the marker can straddle
+	// the boundary.
+	var i int
+	for from := 0; ; {
+		rest := l.input[l.pos-l.base:]
+		if j := strings.Index(rest[from:], rightStream); j >= 0 {
+			i = from + j
+			break
+		}
+		if from = len(rest) - len(rightStream) + 1; from < 0 {
+			from = 0
+		}
+		if !l.fill() {
+			if l.errorf(ErrBadStream, "unclosed stream") == nil {
+				return nil
+			}
+			// recovering, so the rest of the input is the body
+			l.pos = l.base + Pos(len(l.input))
+			l.emit(ItemStreamBody)
+			return lexDefault
+		}
 	}
 
-	substr := l.input[l.pos : l.pos+Pos(i)]
+	substr := l.input[l.pos-l.base : l.pos-l.base+Pos(i)]
 	// We have now consumed the stream contents AND a whitespace separator. We
 	// actually want to emit the stream body token 'bare', so now we need to
 	// walk backwards past those spaces.
 	for {
 		r, size := utf8.DecodeLastRuneInString(substr)
-		if !unicode.IsSpace(r) || len(substr) <= 0 {
+		if l.mode&ByteExact != 0 && size > 0 {
+			r, size = rune(substr[len(substr)-1]), 1
+		}
+		if !l.isWhite(r) || len(substr) <= 0 {
 			break
 		}
 		substr = substr[:len(substr)-size]
 	}
 
+	if length >= 0 && length != len(substr) {
+		l.mu.Lock()
+		l.mismatches = append(l.mismatches, LengthMismatch{l.start, length, len(substr)})
+		l.mu.Unlock()
+	}
+
 	l.pos += Pos(len(substr))
 	l.emit(ItemStreamBody)
 
@@ -309,6 +797,27 @@ func lexStream(l *Lexer) stateFn {
 	return lexDefault
 }
 
+// maxStreamPad is how much whitespace atLength allows between the end of a
+// stream body and the endstream keyword.
+const maxStreamPad = 32
+
+// atLength reports whether the endstream keyword follows the next n bytes of
+// input, allowing for whitespace in between.
+func (l *Lexer) atLength(n int) bool {
+	want := n + maxStreamPad + len(rightStream)
+	for len(l.input)-int(l.pos-l.base) < want && l.fill() {
+	}
+	rest := l.input[l.pos-l.base:]
+	if len(rest) < n {
+		return false
+	}
+	rest = rest[n:]
+	for len(rest) > 0 && isWhiteByte(rune(rest[0])) {
+		rest = rest[1:]
+	}
+	return strings.HasPrefix(rest, rightStream)
+}
+
 // lexLeftDict scans the left delimiter, which is known to be present.
 func lexLeftDict(l *Lexer) stateFn {
 	l.pos += Pos(len(leftDict))
@@ -355,14 +864,14 @@ func lexRightDict(l *Lexer) stateFn {
 func lexName(l *Lexer) stateFn {
 	for {
 		switch r := l.next(); {
-		case isDelim(r) || unicode.IsSpace(r) || r == lexEOF:
+		case isDelim(r) || l.isWhite(r) || r == lexEOF:
 			l.backup()
 			l.emit(ItemName)
 			return lexDefault
 		case 0x20 < r && r < 0x7f:
 			break
 		default:
-			return l.errorf("illegal character in name: %#U", r)
+			return l.errorf(ErrIllegalNameChar, "illegal character in name: %#U", r)
 		}
 	}
 }
@@ -394,7 +903,7 @@ func lexStringObj(l *Lexer) stateFn {
 				return lexDefault
 			}
 		case lexEOF:
-			return l.errorf("unterminated string object")
+			return l.errorf(ErrUnterminatedString, "unterminated string object")
 		default:
 		}
 	}
@@ -407,15 +916,15 @@ func lexHexObj(l *Lexer) stateFn {
 	digits := "0123456789abcdefABCDEF"
 	for {
 		switch r := l.next(); {
-		case strings.IndexRune(digits, r) >= 0 || unicode.IsSpace(r):
+		case strings.IndexRune(digits, r) >= 0 || l.isWhite(r):
 			//
 		case r == '>':
 			l.emit(ItemHexString)
 			return lexDefault
 		case r == lexEOF:
-			return l.errorf("unterminated hexstring")
+			return l.errorf(ErrUnterminatedString, "unterminated hexstring")
 		default:
-			return l.errorf("illegal character in hexstring: %#U", r)
+			return l.errorf(ErrBadHexString, "illegal character in hexstring: %#U", r)
 		}
 	}
 }
@@ -423,10 +932,10 @@ func lexHexObj(l *Lexer) stateFn {
 // lexSpace scans a run of space characters one of which has already been seen.
 // cf PDF3200_2008.pdf 7.2.2
 func lexSpace(l *Lexer) stateFn {
-	// This is more permissive than the spec, which doesn't mention U+0085
-	// (NEL), U+00A0 (NBSP)
+	// Unless the lexer is ByteExact this is more permissive than the spec,
+	// which doesn't mention U+0085 (NEL), U+00A0 (NBSP)
 	// We don't allow space runs that include any EOL chars.
-	for isSpace(l.peek()) {
+	for l.isSpace(l.peek()) {
 		l.next()
 	}
 	l.emit(ItemSpace)
@@ -439,11 +948,15 @@ func lexSpace(l *Lexer) stateFn {
 // catchall itemWord and then return to lexDefault
 func lexWord(l *Lexer) stateFn {
 
-	for isAlphaNumeric(l.peek()) {
+	for l.isAlphaNumeric(l.peek()) || (l.peek() == '*' && l.mode&Content != 0) {
 		l.next()
 	}
 
-	tok, found := keytoks[l.input[l.start:l.pos]]
+	if l.mode&Content != 0 {
+		return lexContentWord
+	}
+
+	tok, found := keytoks[l.current()]
 	if found {
 		// known token type, emit it
 		l.emit(tok)
@@ -459,11 +972,78 @@ func lexWord(l *Lexer) stateFn {
 	return lexDefault
 }
 
+// lexContentWord emits a word from a content stream, where the only keywords
+// are the operators and the basic object types.
+func lexContentWord(l *Lexer) stateFn {
+	word := l.current()
+	switch tok := keytoks[word]; {
+	case operators[word]:
+		l.emit(ItemOperator)
+		if word == "ID" {
+			return lexInlineImage
+		}
+	case tok == ItemTrue || tok == ItemFalse || tok == ItemNull:
+		l.emit(tok)
+	default:
+		l.emit(ItemWord)
+	}
+	return lexDefault
+}
+
+// lexInlineImage scans the data of an inline image. The ID operator has just
+// been emitted, and should be followed by a single whitespace character, the
+// data, whitespace and then the EI operator. The data is binary, so the end is
+// taken to be the first EI which is surrounded by whitespace, or followed by a
+// delimiter or the end of the input.
+// cf PDF3200_2008.pdf 8.9.7
+func lexInlineImage(l *Lexer) stateFn {
+	r := l.next()
+	switch {
+	case isEndOfLine(r):
+		l.emit(ItemEOL)
+	case isWhiteByte(r):
+		l.emit(ItemSpace)
+	default:
+		l.backup()
+		return l.errorf(ErrBadInlineImage, "expected whitespace after ID, got: %#U", r)
+	}
+
+	for from := 0; ; {
+		rest := l.input[l.pos-l.base:]
+		j := strings.Index(rest[from:], "EI")
+		if j < 0 || from+j+2 == len(rest) {
+			// need more input to find EI, or to check what follows it
+			if l.fill() {
+				if j < 0 {
+					from = max(0, len(rest)-1)
+				}
+				continue
+			}
+			if j < 0 {
+				return l.errorf(ErrBadInlineImage, "unterminated inline image")
+			}
+		}
+		j += from
+		after := j+2 == len(rest) || isWhiteByte(rune(rest[j+2])) || isDelim(rune(rest[j+2]))
+		switch {
+		case j == 0 && after:
+			// no data at all
+			l.emit(ItemInlineImageData)
+			return lexDefault
+		case j > 0 && isWhiteByte(rune(rest[j-1])) && after:
+			l.pos += Pos(j - 1)
+			l.emit(ItemInlineImageData)
+			return lexDefault
+		}
+		from = j + 1
+	}
+}
+
 // lexNumber scans a decimal or real number
 // cf PDF3200_2008.pdf 7.3.3
 func lexNumber(l *Lexer) stateFn {
 	if !l.scanNumber() {
-		return l.errorf("bad number syntax: %q", l.input[l.start:l.pos])
+		return l.errorf(ErrBadNumber, "bad number syntax: %q", l.current())
 	}
 	l.emit(ItemNumber)
 	return lexDefault
@@ -478,7 +1058,7 @@ func (l *Lexer) scanNumber() bool {
 		l.acceptRun(digits)
 	}
 	// Next thing must be a delimeter, space char or lexEOF
-	if isDelim(l.peek()) || unicode.IsSpace(l.peek()) || l.peek() == lexEOF {
+	if isDelim(l.peek()) || l.isWhite(l.peek()) || l.peek() == lexEOF {
 		return true
 	}
 	l.next()
@@ -501,8 +1081,23 @@ func isEndOfLine(r rune) bool {
 	return r == '\r' || r == '\n'
 }
 
-func isSpace(r rune) bool {
-	return unicode.IsSpace(r) && !isEndOfLine(r)
+// isWhite reports whether r is a whitespace character, including EOL.
+// cf PDF3200_2008.pdf 7.2.2 Table 1
+func (l *Lexer) isWhite(r rune) bool {
+	if l.mode&ByteExact != 0 {
+		return isWhiteByte(r)
+	}
+	return unicode.IsSpace(r)
+}
+
+// isWhiteByte reports whether r is one of the 6 PDF whitespace characters.
+func isWhiteByte(r rune) bool {
+	return strings.IndexRune("\x00\t\n\f\r ", r) >= 0
+}
+
+// isSpace reports whether r is a whitespace character other than EOL.
+func (l *Lexer) isSpace(r rune) bool {
+	return l.isWhite(r) && !isEndOfLine(r)
 }
 
 // isDelim reports whether r is one of the 10 reserved PDF delimiter characters
@@ -512,6 +1107,9 @@ func isDelim(r rune) bool {
 }
 
 // isAlphaNumeric reports whether r is an alphabetic, digit, or underscore.
-func isAlphaNumeric(r rune) bool {
+func (l *Lexer) isAlphaNumeric(r rune) bool {
+	if l.mode&ByteExact != 0 {
+		return r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+	}
 	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
 }
@@ -2,7 +2,13 @@ package pdflex
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var pdf = `%PDF-1.1
@@ -70,6 +76,9 @@ var unterminatedDict = `/Author (Fred Nerk)<<`
 var extraDictTerminator = `/Author (Fred Nerk)>>`
 var unterminatedArray = `/Author (Fred Nerk)[`
 var extraArrayTerminator = `/Author (Fred Nerk)]`
+var unterminatedBrace = `/Author (Fred Nerk){`
+var extraBraceTerminator = `/Author (Fred Nerk)}`
+var calculator = `{ 360 mul sin 2 div exch 360 mul sin 2 div add { dup } if }`
 
 func TestRewrite(t *testing.T) {
 	l := NewLexer("test", pdf)
@@ -140,3 +149,474 @@ func TestExtraArrayTerminator(t *testing.T) {
 		t.Fatalf("failed to recognise unexpected array terminator")
 	}
 }
+
+func TestUnterminatedBrace(t *testing.T) {
+	l := NewLexer("test", unterminatedBrace)
+	var toks []string
+	for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		toks = append(toks, i.Val)
+	}
+	if toks[4] != "unterminated brace" {
+		t.Logf("%q ", toks)
+		t.Fatalf("failed to recognise unterminated brace")
+	}
+}
+
+func TestExtraBraceTerminator(t *testing.T) {
+	l := NewLexer("test", extraBraceTerminator)
+	var toks []string
+	for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		toks = append(toks, i.Val)
+	}
+	if toks[4] != "unexpected brace terminator" {
+		t.Logf("%q ", toks)
+		t.Fatalf("failed to recognise unexpected brace terminator")
+	}
+}
+
+func TestCalculator(t *testing.T) {
+	l := NewLexer("test", calculator)
+	var braces []ItemType
+	for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		switch i.Typ {
+		case ItemLeftBrace, ItemRightBrace:
+			braces = append(braces, i.Typ)
+		case ItemError:
+			t.Fatalf("failed to lex calculator function: %s", i.Val)
+		}
+	}
+	want := []ItemType{ItemLeftBrace, ItemLeftBrace, ItemRightBrace, ItemRightBrace}
+	if fmt.Sprint(braces) != fmt.Sprint(want) {
+		t.Fatalf("want braces %v, got %v", want, braces)
+	}
+}
+
+// collect lexes the input completely and returns every item
+func collect(l *Lexer) []Item {
+	var items []Item
+	for i := l.NextItem(); ; i = l.NextItem() {
+		items = append(items, i)
+		if i.Typ == ItemEOF {
+			return items
+		}
+	}
+}
+
+func compareItems(t *testing.T, want, got []Item) {
+	if len(want) != len(got) {
+		t.Fatalf("item count differs, want %d got %d", len(want), len(got))
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("item %d differs, want %#v got %#v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestReaderLexer(t *testing.T) {
+	// Stream bodies bigger than the read size, with the end marker straddling
+	// a read boundary.
+	big := strings.Repeat("x", readSize-len("endst")) + "\nendstream\n"
+	big = "1 0 obj\n<< /Length 1 >>\nstream\n" + big + strings.Repeat(big, 3)
+	for _, in := range []string{pdf, big, unterminatedDict, extraDictTerminator} {
+		want := collect(NewLexer("test", in))
+		compareItems(t, want, collect(NewReaderLexer("test", strings.NewReader(in))))
+		compareItems(t, want, collect(NewReaderLexer("test", iotest.OneByteReader(strings.NewReader(in)))))
+		compareItems(t, want, collect(NewReaderLexer("test", iotest.HalfReader(strings.NewReader(in)))))
+	}
+}
+
+func TestReaderLexerError(t *testing.T) {
+	r := iotest.TimeoutReader(strings.NewReader(strings.Repeat(" ", readSize+1)))
+	items := collect(NewReaderLexer("test", r))
+	if e := items[len(items)-2]; e.Typ != ItemError || !strings.Contains(e.Val, iotest.ErrTimeout.Error()) {
+		t.Fatalf("failed to report read error, got %#v", e)
+	}
+}
+
+func TestLineNumber(t *testing.T) {
+	l := NewReaderLexer("test", strings.NewReader(pdf))
+	for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		want := 1 + strings.Count(pdf[:i.Pos], "\n")
+		if l.LineNumber() != want {
+			t.Fatalf("wrong line for %#v, want %d got %d", i, want, l.LineNumber())
+		}
+	}
+}
+
+func byteExact(in string) []Item {
+	l := NewLexer("test", in)
+	l.SetMode(ByteExact)
+	return collect(l)
+}
+
+func TestByteExactASCII(t *testing.T) {
+	// NUL and VT are the only ASCII characters where the unicode package
+	// and the spec disagree about whitespace, see TestByteExactWhitespace
+	inputs := []string{pdf, escapedSlash, unterminatedDict, extraArrayTerminator}
+	for b := 1; b < 0x80; b++ {
+		if b == '\v' {
+			continue
+		}
+		c := string(rune(b))
+		inputs = append(inputs,
+			"/A"+c+"/B", "["+c+"]", "("+c+")", "<"+c+">", "1"+c+"2", "%"+c+"\n", "a"+c+"b",
+		)
+	}
+	for _, in := range inputs {
+		compareItems(t, collect(NewLexer("test", in)), byteExact(in))
+	}
+}
+
+// sameBoundaries compares item types and positions, but not values, because
+// errors about invalid UTF-8 report U+FFFD by default and the byte otherwise.
+func sameBoundaries(a, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Typ != b[i].Typ || a[i].Pos != b[i].Pos {
+			return false
+		}
+	}
+	return true
+}
+
+func TestByteExactNonASCII(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		diverge bool
+	}{
+		{"1\u00a02", true},    // NBSP is unicode whitespace
+		{"1\u00852", true},    // as is NEL
+		{"caf\u00e9", true},   // UTF-8 letters are accepted in words
+		{"caf\xe9 x", false},  // a Latin-1 letter is illegal either way...
+		{"/caf\xe9 x", false}, // ...as is any non-ASCII name character
+		{"(caf\xe9)", false},  // strings can hold anything
+	} {
+		if sameBoundaries(collect(NewLexer("test", tc.in)), byteExact(tc.in)) == tc.diverge {
+			t.Fatalf("modes diverge on %q: want %v", tc.in, tc.diverge)
+		}
+		for _, i := range byteExact(tc.in) {
+			if i.Typ == ItemSpace && i.Val != " " {
+				t.Fatalf("byte exact mode lexed %q as space", i.Val)
+			}
+		}
+	}
+}
+
+func TestByteExactWhitespace(t *testing.T) {
+	nul, vt := "/A\x00/B", "/A\v/B"
+	if items := byteExact(nul); items[1].Typ != ItemSpace || items[1].Val != "\x00" {
+		t.Fatalf("NUL should be whitespace, got %#v", items[1])
+	}
+	if items := byteExact(vt); items[0].Typ != ItemError {
+		t.Fatalf("VT should not be whitespace, got %#v", items[0])
+	}
+	if items := collect(NewLexer("test", nul)); items[0].Typ != ItemError {
+		t.Fatalf("NUL should not be whitespace by default, got %#v", items[0])
+	}
+	if items := collect(NewLexer("test", vt)); items[1].Typ != ItemSpace {
+		t.Fatalf("VT should be whitespace by default, got %#v", items[1])
+	}
+}
+
+func TestStreamLength(t *testing.T) {
+	for _, tc := range []struct {
+		desc, in, body string
+		mismatch       bool
+	}{
+		{"keyword in data", "<</Length 18>>\nstream\nxx\nendstream\nyy  \r\nendstream", "xx\nendstream\nyy  \r", false},
+		{"trailing space", "<</Length 4>>\nstream\nab \n\nendstream", "ab \n", false},
+		{"no EOL", "<</Length 2>>\nstream\nabendstream", "ab", false},
+		{"too long", "<</Length 9>>\nstream\nab\nendstream", "ab", true},
+		{"too short", "<</Length 1>>\nstream\nab\nendstream", "ab", true},
+		{"indirect", "<</Length 1 0 R>>\nstream\nab \nendstream", "ab", false},
+		{"nested", "<</DecodeParms<</Length 1>>>>\nstream\nab\nendstream", "ab", false},
+		{"not last", "<</Length 1>>[]\nstream\nab\nendstream", "ab", false},
+		{"empty", "<</Length 0>>\nstream\n\nendstream", "", false},
+	} {
+		l := NewLexer("test", tc.in)
+		var b bytes.Buffer
+		body := "missing"
+		for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+			if i.Typ == ItemStreamBody {
+				body = i.Val
+			}
+			b.WriteString(i.Val)
+		}
+		if b.String() != tc.in {
+			t.Fatalf("%s: failed in rewrite - strings not equal", tc.desc)
+		}
+		if body != tc.body {
+			t.Fatalf("%s: want body %q, got %q", tc.desc, tc.body, body)
+		}
+		if m := l.LengthMismatches(); (len(m) > 0) != tc.mismatch {
+			t.Fatalf("%s: unexpected mismatches %#v", tc.desc, m)
+		}
+	}
+}
+
+func recovering(in string) []Item {
+	l := NewLexer("test", in)
+	l.SetMode(Recover)
+	return collect(l)
+}
+
+// rewrite joins the values of all items except errors
+func rewrite(items []Item) string {
+	var b bytes.Buffer
+	for _, i := range items {
+		if i.Typ != ItemError {
+			b.WriteString(i.Val)
+		}
+	}
+	return b.String()
+}
+
+func TestRecover(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		errors int
+		last   ItemType // last item before EOF
+	}{
+		{"/A\x01B /C", 1, ItemName},
+		{"/A > /C", 1, ItemName},
+		{"1 0 R] /C", 1, ItemName},
+		{">> /C", 1, ItemName},
+		{"<< /C [", 2, ItemError},
+		{"1.2.3 foo", 1, ItemWord},
+		{"<12z34> /C", 2, ItemName},
+		{"(abc", 1, ItemInvalid},
+		{"{ /C", 1, ItemError},
+		{"} /C", 1, ItemName},
+		{"stream foo\nendstream", 1, ItemEndStream},
+		{"stream\nfoo", 1, ItemStreamBody},
+		{pdf, 0, ItemEOL},
+	} {
+		items := recovering(tc.in)
+		if got := rewrite(items); got != tc.in {
+			t.Fatalf("%q: failed in rewrite, got %q", tc.in, got)
+		}
+		errors := 0
+		for _, i := range items {
+			if i.Typ == ItemError {
+				errors++
+			}
+		}
+		if errors != tc.errors {
+			t.Fatalf("%q: want %d errors, got %d in %#v", tc.in, tc.errors, errors, items)
+		}
+		if last := items[len(items)-2]; last.Typ != tc.last {
+			t.Fatalf("%q: want last item type %d, got %#v", tc.in, tc.last, last)
+		}
+	}
+}
+
+func TestRecoverGarbage(t *testing.T) {
+	// Every byte of a corrupted file should come back, without hanging.
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		in := []byte(pdf)
+		for j := 0; j < 10; j++ {
+			in[rnd.Intn(len(in))] = byte(rnd.Intn(256))
+		}
+		if got := rewrite(recovering(string(in))); got != string(in) {
+			t.Fatalf("failed in rewrite of %q", in)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	for _, in := range []string{pdf, unterminatedDict, extraArrayTerminator} {
+		want := collect(NewLexer("test", in))
+		var got []Item
+		l := NewLexer("test", in)
+		for i := l.Next(); ; i = l.Next() {
+			got = append(got, i)
+			if i.Typ == ItemEOF {
+				break
+			}
+		}
+		compareItems(t, want, got)
+		// EOF is sticky
+		if i := l.Next(); i.Typ != ItemEOF {
+			t.Fatalf("want ItemEOF after EOF, got %#v", i)
+		}
+	}
+}
+
+func TestItems(t *testing.T) {
+	want := collect(NewLexer("test", pdf))
+	var got []Item
+	for i := range NewLexer("test", pdf).Items() {
+		got = append(got, i)
+	}
+	compareItems(t, want[:len(want)-1], got)
+
+	l := NewLexer("test", pdf)
+	for range l.Items() {
+		break
+	}
+	if i := l.Next(); i != want[1] {
+		t.Fatalf("iteration didn't stop cleanly, next item is %#v", i)
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for n := 0; n < 10; n++ {
+		l := NewLexer("test", pdf)
+		l.NextItem()
+		l.Close()
+		l.Close()
+		if i := l.NextItem(); i.Typ != ItemEOF {
+			t.Fatalf("want ItemEOF after Close, got %#v", i)
+		}
+	}
+	// Closing a lexer that never started is fine too
+	NewLexer("test", pdf).Close()
+	for n := 0; n < 100 && runtime.NumGoroutine() > before; n++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > before {
+		t.Fatalf("leaked %d goroutines", runtime.NumGoroutine()-before)
+	}
+}
+
+func TestResultsWhileScanning(t *testing.T) {
+	// Run with -race: the NextItem goroutine appends to both while they are
+	// read here
+	in := strings.Repeat("1 0 obj\n<< /Length 99 >>\nstream\nxx\nendstream\nendobj\n) ", 200)
+	l := NewLexer("test", in)
+	l.SetMode(Recover)
+	n := 0
+	for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		n += len(l.LengthMismatches()) + len(l.Errors())
+	}
+	if len(l.LengthMismatches()) != 200 || len(l.Errors()) != 200 || n == 0 {
+		t.Fatalf("want 200 mismatches and errors, got %d and %d", len(l.LengthMismatches()), len(l.Errors()))
+	}
+}
+
+func BenchmarkNextItem(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		l := NewLexer("bench", pdf)
+		for i := l.NextItem(); i.Typ != ItemEOF; i = l.NextItem() {
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		l := NewLexer("bench", pdf)
+		for i := l.Next(); i.Typ != ItemEOF; i = l.Next() {
+		}
+	}
+}
+
+func TestLineCol(t *testing.T) {
+	// The stream body ends with CR, and the LF after it is a separate item
+	in := "%a\r%b\n%c\r\n/d /e\r\r\n<</Length 2>>stream\r\nx\r\nendstream\n\n( \r\n)\n\\"
+	want := []struct {
+		val       string
+		line, col int
+	}{
+		{"%a", 1, 1}, {"\r", 1, 3}, {"%b", 2, 1}, {"\n", 2, 3}, {"%c", 3, 1},
+		{"\r\n", 3, 3}, {"/d", 4, 1}, {" ", 4, 3}, {"/e", 4, 4}, {"\r", 4, 6},
+		{"\r\n", 5, 1}, {"<<", 6, 1}, {"/Length", 6, 3}, {" ", 6, 10}, {"2", 6, 11},
+		{">>", 6, 12}, {"stream", 6, 14}, {"\r\n", 6, 20}, {"x\r", 7, 1}, {"\n", 8, 1},
+		{"endstream", 8, 1}, {"\n", 8, 10}, {"\n", 9, 1}, {"( \r\n)", 10, 1}, {"\n", 11, 2},
+		{"illegal character: U+005C '\\'", 12, 1},
+	}
+	l := NewLexer("test", in)
+	for _, w := range want {
+		i := l.Next()
+		if i.Val != w.val || i.Line != w.line || i.Col != w.col {
+			t.Fatalf("want %q at %d:%d, got %#v", w.val, w.line, w.col, i)
+		}
+		if l.LineNumber() != w.line {
+			t.Fatalf("want LineNumber %d, got %d", w.line, l.LineNumber())
+		}
+	}
+}
+
+func TestItemTypeNames(t *testing.T) {
+	for typ := ItemError; typ <= ItemNull; typ++ {
+		for _, name := range []string{typ.String(), "Item" + typ.String()} {
+			if got, err := ParseItemType(name); err != nil || got != typ {
+				t.Fatalf("failed to parse %q, got %v, %v", name, got, err)
+			}
+		}
+	}
+	if s := ItemStreamBody.String(); s != "StreamBody" {
+		t.Fatalf("want StreamBody, got %q", s)
+	}
+	if _, err := ParseItemType("Bogus"); err == nil {
+		t.Fatalf("failed to reject unknown item type")
+	}
+	want := `pdflex.Item{Typ:pdflex.ItemName, Pos:1, Val:"/A", Line:1, Col:2}`
+	if s := fmt.Sprintf("%#v", Item{Typ: ItemName, Pos: 1, Val: "/A", Line: 1, Col: 2}); s != want {
+		t.Fatalf("want %s, got %s", want, s)
+	}
+	if s := fmt.Sprintf("%#v", ItemType(-1)); s != "pdflex.ItemType(-1)" {
+		t.Fatalf("unexpected GoString for invalid type %s", s)
+	}
+}
+
+var content = "q 1 0 0 1 72 720 cm\nBT /F1 18 Tf 0 0 Td (Hello World) Tj T* (a) ' 1 2 (b) \" ET\n" +
+	"0 0 m 10 10 l b* f* W* n Q\n" +
+	"BI /W 2 /H 2 /BPC 8 /CS /G /F [/AHx] ID\n\x00EI\xffE\nEIx\rEI Q % done\nBI /W 0 ID EI"
+
+func TestContentLexer(t *testing.T) {
+	want := []struct {
+		typ ItemType
+		val string
+	}{
+		{ItemOperator, "q"}, {ItemOperator, "cm"}, {ItemOperator, "BT"}, {ItemName, "/F1"},
+		{ItemNumber, "18"}, {ItemOperator, "Tf"}, {ItemOperator, "Td"}, {ItemString, "(Hello World)"},
+		{ItemOperator, "Tj"}, {ItemOperator, "T*"}, {ItemString, "(a)"}, {ItemOperator, "'"},
+		{ItemString, "(b)"}, {ItemOperator, `"`}, {ItemOperator, "ET"}, {ItemOperator, "m"},
+		{ItemOperator, "l"}, {ItemOperator, "b*"}, {ItemOperator, "f*"}, {ItemOperator, "W*"},
+		{ItemOperator, "n"}, {ItemOperator, "Q"}, {ItemOperator, "BI"}, {ItemName, "/W"},
+		{ItemName, "/F"}, {ItemLeftArray, "["}, {ItemName, "/AHx"}, {ItemRightArray, "]"},
+		{ItemOperator, "ID"}, {ItemInlineImageData, "\x00EI\xffE\nEIx"}, {ItemOperator, "EI"},
+		{ItemOperator, "Q"}, {ItemComment, "% done"}, {ItemOperator, "BI"}, {ItemOperator, "ID"},
+		{ItemInlineImageData, ""}, {ItemOperator, "EI"},
+	}
+	for _, l := range []*Lexer{
+		NewContentLexer("test", content),
+		func() *Lexer {
+			l := NewReaderLexer("test", iotest.OneByteReader(strings.NewReader(content)))
+			l.SetMode(Content)
+			return l
+		}(),
+	} {
+		items := collect(l)
+		if got := rewrite(items); got != content {
+			t.Fatalf("failed in rewrite, got %q", got)
+		}
+		j := 0
+		for _, i := range items {
+			if j < len(want) && i.Val == want[j].val {
+				if i.Typ != want[j].typ {
+					t.Fatalf("want %q to be %v, got %v", i.Val, want[j].typ, i.Typ)
+				}
+				j++
+			}
+			if i.Typ == ItemError || i.Typ == ItemWord {
+				t.Fatalf("unexpected item %#v", i)
+			}
+		}
+		if j != len(want) {
+			t.Fatalf("missing %#v", want[j])
+		}
+	}
+	// the same stream doesn't lex as a file
+	if items := collect(NewLexer("test", content)); items[len(items)-2].Typ != ItemError {
+		t.Fatalf("content stream unexpectedly lexed as a file")
+	}
+	if items := collect(NewContentLexer("test", "BI ID\nxx")); items[len(items)-2].Typ != ItemError {
+		t.Fatalf("failed to detect unterminated inline image")
+	}
+}
@@ -0,0 +1,332 @@
+package pdflex
+
+import "io"
+
+// Span is the range of input an Object was parsed from, from the first byte
+// of its first item up to, but not including, End.
+type Span struct {
+	Start, End Pos
+}
+
+// Object is any parsed PDF object. The concrete types are Name, String,
+// Number, Bool, Null, Array, Dict, Ref, Stream, IndirectObject and Keyword.
+// cf PDF3200_2008.pdf 7.3
+type Object interface {
+	Span() Span
+}
+
+// spanned records where an Object came from. Objects that weren't parsed
+// have a zero Span.
+type spanned struct {
+	span Span
+}
+
+func (s spanned) Span() Span { return s.span }
+
+// Name is a PDF Name Object, 7.3.5. Value is decoded, without the leading
+// solidus. Raw is the original spelling.
+type Name struct {
+	spanned
+	Value string
+	Raw   string
+}
+
+// String is a literal or hexadecimal PDF String, 7.3.4. Value is decoded, Raw
+// is the original spelling including delimiters.
+type String struct {
+	spanned
+	Value []byte
+	Hex   bool
+	Raw   string
+}
+
+// Number is a PDF integer or real, 7.3.3. Float is always set, Int only when
+// IsInt is true.
+type Number struct {
+	spanned
+	IsInt bool
+	Int   int64
+	Float float64
+	Raw   string
+}
+
+// Bool is a PDF boolean, 7.3.2
+type Bool struct {
+	spanned
+	Value bool
+}
+
+// Null is the PDF null object, 7.3.9
+type Null struct {
+	spanned
+}
+
+// Array is a PDF Array, 7.3.6
+type Array struct {
+	spanned
+	Elems []Object
+}
+
+// DictEntry is one key value pair in a Dict
+type DictEntry struct {
+	Key   Name
+	Value Object
+}
+
+// Dict is a PDF Dictionary, 7.3.7. Entries are kept in their original order.
+type Dict struct {
+	spanned
+	Entries []DictEntry
+}
+
+// Get returns the value for the decoded key, or nil if there isn't one. If the
+// key appears more than once the last value wins.
+func (d Dict) Get(key string) Object {
+	for j := len(d.Entries) - 1; j >= 0; j-- {
+		if d.Entries[j].Key.Value == key {
+			return d.Entries[j].Value
+		}
+	}
+	return nil
+}
+
+// Ref is an indirect reference, N G R. 7.3.10
+type Ref struct {
+	spanned
+	Num, Gen int
+}
+
+// Stream is a PDF Stream, 7.3.8. Raw is the body exactly as it appears in the
+// input, and Body is where it was found.
+type Stream struct {
+	spanned
+	Dict Dict
+	Raw  []byte
+	Body Span
+}
+
+// IndirectObject is an object wrapped in N G obj ... endobj, 7.3.10
+type IndirectObject struct {
+	spanned
+	Num, Gen int
+	Value    Object
+}
+
+// Keyword is any bare word that isn't part of an object, such as xref,
+// trailer or startxref at the top level of a file, or an operator in a
+// content stream.
+type Keyword struct {
+	spanned
+	Value string
+}
+
+// ObjectParser builds Objects from the items returned by a Lexer. Whitespace,
+// line breaks and comments are skipped.
+type ObjectParser struct {
+	l     *Lexer
+	ahead []Item // significant items that have been read but not used
+}
+
+// NewObjectParser returns an ObjectParser reading items from l with Next.
+func NewObjectParser(l *Lexer) *ObjectParser {
+	return &ObjectParser{l: l}
+}
+
+// peek returns the nth significant item after the current one without
+// consuming anything.
+func (p *ObjectParser) peek(n int) Item {
+	for len(p.ahead) <= n {
+		i := p.l.Next()
+		switch i.Typ {
+		case ItemSpace, ItemEOL, ItemComment:
+			continue
+		}
+		p.ahead = append(p.ahead, i)
+	}
+	return p.ahead[n]
+}
+
+// next consumes and returns the next significant item.
+func (p *ObjectParser) next() Item {
+	i := p.peek(0)
+	if i.Typ != ItemEOF {
+		p.ahead = p.ahead[1:]
+	}
+	return i
+}
+
+// errorf returns an *Error describing a problem at item i. For an ItemError
+// it returns the Lexer's own error, which has the right kind.
+func (p *ObjectParser) errorf(kind error, i Item, format string, args ...interface{}) error {
+	if i.Typ == ItemError {
+		if e, ok := p.l.errorAt(i.Pos); ok {
+			return e
+		}
+		format, args = "%s", []interface{}{i.Val}
+	}
+	e := newError(kind, i, format, args...)
+	e.Name = p.l.name
+	return e
+}
+
+// decodeError adds the input name to err, returned by an Item decoding
+// method.
+func (p *ObjectParser) decodeError(err error) error {
+	if e, ok := err.(*Error); ok {
+		e.Name = p.l.name
+	}
+	return err
+}
+
+// end returns the position just after item i.
+func end(i Item) Pos {
+	return i.Pos + Pos(len(i.Val))
+}
+
+// isObjNum reports whether i could be an object or generation number.
+func isObjNum(i Item) bool {
+	n, err := i.Int()
+	return err == nil && n >= 0
+}
+
+// Next parses the next top level object. In a well formed file this is an
+// IndirectObject, or a Keyword and the objects that follow it in the xref
+// section and trailer. It returns io.EOF at the end of the input.
+func (p *ObjectParser) Next() (Object, error) {
+	switch {
+	case p.peek(0).Typ == ItemEOF:
+		return nil, io.EOF
+	case isObjNum(p.peek(0)) && isObjNum(p.peek(1)) && p.peek(2).Typ == ItemObj:
+		return p.indirect()
+	}
+	return p.ParseObject()
+}
+
+// indirect parses N G obj ... endobj, which is known to be next. If the value
+// is a dict followed by a stream body, the value is a Stream. A missing endobj
+// is tolerated, since it is so common.
+func (p *ObjectParser) indirect() (Object, error) {
+	num, gen, _ := p.next(), p.next(), p.next()
+	o := IndirectObject{}
+	n, _ := num.Int()
+	g, _ := gen.Int()
+	o.Num, o.Gen = int(n), int(g)
+
+	v, err := p.ParseObject()
+	if err != nil {
+		return nil, err
+	}
+	last := v.Span().End
+	if d, ok := v.(Dict); ok && p.peek(0).Typ == ItemStream {
+		p.next()
+		body := p.next()
+		if body.Typ != ItemStreamBody {
+			return nil, p.errorf(ErrBadStream, body, "expected stream body, got %v", body.Typ)
+		}
+		e := p.next()
+		if e.Typ != ItemEndStream {
+			return nil, p.errorf(ErrBadStream, e, "expected endstream, got %v", e.Typ)
+		}
+		last = end(e)
+		v = Stream{
+			spanned: spanned{Span{d.span.Start, last}},
+			Dict:    d,
+			Raw:     []byte(body.Val),
+			Body:    Span{body.Pos, end(body)},
+		}
+	}
+	if p.peek(0).Typ == ItemEndObj {
+		last = end(p.next())
+	}
+	o.Value = v
+	o.span = Span{num.Pos, last}
+	return o, nil
+}
+
+// ParseObject parses one direct object, or an indirect reference.
+func (p *ObjectParser) ParseObject() (Object, error) {
+	i := p.next()
+	at := spanned{Span{i.Pos, end(i)}}
+	switch i.Typ {
+	case ItemError:
+		return nil, p.errorf(ErrSyntax, i, "")
+	case ItemEOF:
+		return nil, io.ErrUnexpectedEOF
+	case ItemNumber:
+		if isObjNum(i) && isObjNum(p.peek(0)) && p.peek(1).Typ == ItemWord && p.peek(1).Val == "R" {
+			n, _ := i.Int()
+			g, _ := p.next().Int()
+			at.span.End = end(p.next())
+			return Ref{at, int(n), int(g)}, nil
+		}
+		f, err := i.Float()
+		if err != nil {
+			return nil, p.decodeError(err)
+		}
+		n, err := i.Int()
+		return Number{at, err == nil, n, f, i.Val}, nil
+	case ItemName:
+		s, err := i.Name()
+		if err != nil {
+			return nil, p.decodeError(err)
+		}
+		return Name{at, s, i.Val}, nil
+	case ItemString, ItemHexString:
+		b, err := i.Bytes()
+		if err != nil {
+			return nil, p.decodeError(err)
+		}
+		return String{at, b, i.Typ == ItemHexString, i.Val}, nil
+	case ItemTrue, ItemFalse:
+		return Bool{at, i.Typ == ItemTrue}, nil
+	case ItemNull:
+		return Null{at}, nil
+	case ItemLeftArray:
+		a := Array{spanned: at}
+		for p.peek(0).Typ != ItemRightArray {
+			v, err := p.element()
+			if err != nil {
+				return nil, err
+			}
+			a.Elems = append(a.Elems, v)
+		}
+		a.span.End = end(p.next())
+		return a, nil
+	case ItemLeftDict:
+		d := Dict{spanned: at}
+		for p.peek(0).Typ != ItemRightDict {
+			k, err := p.element()
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(Name)
+			if !ok {
+				return nil, p.errorf(ErrSyntax, i, "dict key at pos %d is not a name", k.Span().Start)
+			}
+			if p.peek(0).Typ == ItemRightDict {
+				return nil, p.errorf(ErrSyntax, p.peek(0), "missing value for dict key %s", key.Raw)
+			}
+			v, err := p.element()
+			if err != nil {
+				return nil, err
+			}
+			d.Entries = append(d.Entries, DictEntry{key, v})
+		}
+		d.span.End = end(p.next())
+		return d, nil
+	case ItemWord, ItemOperator, ItemObj, ItemEndObj, ItemStream, ItemEndStream,
+		ItemTrailer, ItemXref, ItemStartXref:
+		return Keyword{at, i.Val}, nil
+	}
+	return nil, p.errorf(ErrSyntax, i, "unexpected %v %q", i.Typ, i.Val)
+}
+
+// element parses an object inside an array or dict, where the file structure
+// keywords can't appear.
+func (p *ObjectParser) element() (Object, error) {
+	switch i := p.peek(0); i.Typ {
+	case ItemObj, ItemEndObj, ItemStream, ItemEndStream, ItemTrailer, ItemXref, ItemStartXref:
+		return nil, p.errorf(ErrSyntax, i, "unexpected %q", i.Val)
+	}
+	return p.ParseObject()
+}
@@ -0,0 +1,177 @@
+package pdflex
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func parseAll(t *testing.T, in string) []Object {
+	p := NewObjectParser(NewLexer("", in))
+	var objs []Object
+	for {
+		o, err := p.Next()
+		if err == io.EOF {
+			return objs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		objs = append(objs, o)
+	}
+}
+
+func spanText(in string, o Object) string {
+	s := o.Span()
+	return in[s.Start:s.End]
+}
+
+func TestObjectParser(t *testing.T) {
+	objs := parseAll(t, pdf)
+	// 4 objects, then xref with its rows, trailer, dict, startxref, offset
+	if len(objs) < 4 {
+		t.Fatalf("want at least 4 objects, got %d", len(objs))
+	}
+	for n, o := range objs[:4] {
+		ind, ok := o.(IndirectObject)
+		if !ok {
+			t.Fatalf("object %d: want IndirectObject, got %T", n, o)
+		}
+		if ind.Num != n+1 || ind.Gen != 0 {
+			t.Fatalf("object %d: got %d %d obj", n, ind.Num, ind.Gen)
+		}
+		txt := spanText(pdf, ind)
+		if !strings.HasPrefix(txt, fmt.Sprintf("%d 0 obj", n+1)) || !strings.HasSuffix(txt, "endobj") {
+			t.Fatalf("object %d: bad span %q", n, txt)
+		}
+	}
+
+	cat := objs[0].(IndirectObject).Value.(Dict)
+	if ty := cat.Get("Type").(Name); ty.Value != "Catalog" || spanText(pdf, ty) != "/Catalog" {
+		t.Fatalf("bad /Type %#v", ty)
+	}
+	if r := cat.Get("Pages").(Ref); r.Num != 2 || r.Gen != 0 || spanText(pdf, r) != "2 0 R" {
+		t.Fatalf("bad /Pages %#v", r)
+	}
+
+	pages := objs[1].(IndirectObject).Value.(Dict)
+	kids := pages.Get("Kids").(Array)
+	if len(kids.Elems) != 1 || spanText(pdf, kids) != "[3 0 R]" {
+		t.Fatalf("bad /Kids %#v", kids)
+	}
+	if c := pages.Get("Count").(Number); !c.IsInt || c.Int != 1 {
+		t.Fatalf("bad /Count %#v", c)
+	}
+
+	page := objs[2].(IndirectObject).Value.(Dict)
+	font := page.Get("Resources").(Dict).Get("Font").(Dict).Get("F1").(Dict)
+	if font.Get("BaseFont").(Name).Value != "Times-Roman" {
+		t.Fatalf("bad font %#v", font)
+	}
+	if page.Get("Missing") != nil {
+		t.Fatalf("found a missing key")
+	}
+
+	s := objs[3].(IndirectObject).Value.(Stream)
+	if !strings.Contains(string(s.Raw), "(Hello World) Tj") {
+		t.Fatalf("bad stream body %q", s.Raw)
+	}
+	if pdf[s.Body.Start:s.Body.End] != string(s.Raw) {
+		t.Fatalf("stream body span doesn't match Raw")
+	}
+	if txt := spanText(pdf, s); !strings.HasPrefix(txt, "<<") || !strings.HasSuffix(txt, "endstream") {
+		t.Fatalf("bad stream span %q", txt)
+	}
+
+	if k, ok := objs[4].(Keyword); !ok || k.Value != "xref" {
+		t.Fatalf("want xref keyword, got %#v", objs[4])
+	}
+	var trailer Dict
+	for j, o := range objs {
+		if k, ok := o.(Keyword); ok && k.Value == "trailer" {
+			trailer = objs[j+1].(Dict)
+		}
+	}
+	if r := trailer.Get("Root").(Ref); r.Num != 1 {
+		t.Fatalf("bad trailer /Root %#v", r)
+	}
+}
+
+func TestObjectParserValues(t *testing.T) {
+	in := `[/A#20B (a\)b) <6869> -1.5 +7 true false null 1 0 R 1 0 [<< >>]]`
+	o, err := NewObjectParser(NewLexer("", in)).ParseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := o.(Array)
+	if len(a.Elems) != 12 {
+		t.Fatalf("want 12 elements, got %d: %#v", len(a.Elems), a.Elems)
+	}
+	if n := a.Elems[0].(Name); n.Value != "A B" || n.Raw != "/A#20B" {
+		t.Fatalf("bad name %#v", n)
+	}
+	if s := a.Elems[1].(String); string(s.Value) != "a)b" || s.Hex {
+		t.Fatalf("bad string %#v", s)
+	}
+	if s := a.Elems[2].(String); string(s.Value) != "hi" || !s.Hex {
+		t.Fatalf("bad hex string %#v", s)
+	}
+	if n := a.Elems[3].(Number); n.IsInt || n.Float != -1.5 {
+		t.Fatalf("bad real %#v", n)
+	}
+	if n := a.Elems[4].(Number); !n.IsInt || n.Int != 7 || n.Float != 7 {
+		t.Fatalf("bad int %#v", n)
+	}
+	if !a.Elems[5].(Bool).Value || a.Elems[6].(Bool).Value {
+		t.Fatalf("bad bools")
+	}
+	if _, ok := a.Elems[7].(Null); !ok {
+		t.Fatalf("bad null %#v", a.Elems[7])
+	}
+	if r := a.Elems[8].(Ref); r.Num != 1 || r.Gen != 0 {
+		t.Fatalf("bad ref %#v", r)
+	}
+	// 1 0 without R is just two numbers
+	if n, ok := a.Elems[10].(Number); !ok || n.Int != 0 {
+		t.Fatalf("bad number %#v", a.Elems[10])
+	}
+	if d := a.Elems[11].(Array).Elems[0].(Dict); len(d.Entries) != 0 || spanText(in, d) != "<< >>" {
+		t.Fatalf("bad empty dict %#v", d)
+	}
+}
+
+func TestObjectParserMissingEndobj(t *testing.T) {
+	in := "1 0 obj << /A 1 >>\n2 0 obj (x) endobj"
+	objs := parseAll(t, in)
+	if len(objs) != 2 {
+		t.Fatalf("want 2 objects, got %#v", objs)
+	}
+	if txt := spanText(in, objs[0]); txt != "1 0 obj << /A 1 >>" {
+		t.Fatalf("bad span %q", txt)
+	}
+	if objs[1].(IndirectObject).Num != 2 {
+		t.Fatalf("bad second object %#v", objs[1])
+	}
+}
+
+func TestObjectParserErrors(t *testing.T) {
+	for _, in := range []string{
+		"<< /A >>",
+		"<< 1 2 >>",
+		"[1 2",
+		"]",
+		"<< /A 1 0 obj >>",
+		"1 0 obj << >> stream\r\n",
+		"<< /A (x",
+	} {
+		p := NewObjectParser(NewLexer("", in))
+		var err error
+		for err == nil {
+			_, err = p.Next()
+		}
+		if err == io.EOF {
+			t.Fatalf("failed to detect error in %q", in)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Spec: 7.5.7
+// An object stream holds other objects, which can then be compressed. The
+// decoded stream starts with /N pairs of object number, offset; the offsets
+// are relative to /First, where the objects themselves start. The embedded
+// objects are bare - there is no obj ... endobj wrapper - and they all have
+// generation 0. Streams can't be stored in an object stream.
+
+// ObjectStream is a decoded /Type /ObjStm stream.
+type ObjectStream struct {
+	Data    []byte           // the decoded stream contents
+	Objects []IndirectObject // the embedded objects, in header order
+}
+
+// DecodeObjectStream decodes s and parses every object in it. The Spans of
+// the objects, and everything in them, are offsets in Data rather than in the
+// file. An /Extends entry is ignored.
+func DecodeObjectStream(s Stream) (*ObjectStream, error) {
+	if t, ok := s.Dict.Get("Type").(Name); !ok || t.Value != "ObjStm" {
+		return nil, fmt.Errorf("not an object stream")
+	}
+	n, ok := dictInt(s.Dict, "N", -1)
+	if !ok || n < 0 {
+		return nil, fmt.Errorf("object stream has invalid or missing /N")
+	}
+	first, ok := dictInt(s.Dict, "First", -1)
+	if !ok || first < 0 {
+		return nil, fmt.Errorf("object stream has invalid or missing /First")
+	}
+	data, err := s.Decode()
+	if err != nil {
+		return nil, fmt.Errorf("object stream: %s", err)
+	}
+	if first > len(data) {
+		return nil, fmt.Errorf("object stream /First %d is past the end of its data", first)
+	}
+
+	st := &ObjectStream{Data: data}
+	hdr := NewObjectParser(NewLexer("", string(data[:first])))
+	for j := 0; j < n; j++ {
+		num, err := hdr.xrefNumber()
+		if err != nil {
+			return nil, fmt.Errorf("object stream header: %s", err)
+		}
+		off, err := hdr.xrefNumber()
+		if err != nil {
+			return nil, fmt.Errorf("object stream header: %s", err)
+		}
+		if off < 0 || off > int64(len(data)-first) {
+			return nil, fmt.Errorf("object %d is past the end of its object stream", num)
+		}
+		pos := first + int(off)
+		p := NewObjectParser(newLexerAt("", bytes.NewReader(data[pos:]), Pos(pos)))
+		v, err := p.ParseObject()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := v.(Keyword); ok {
+			return nil, fmt.Errorf("object %d in object stream is not an object", num)
+		}
+		o := IndirectObject{Num: int(num), Value: v}
+		o.span = v.Span()
+		st.Objects = append(st.Objects, o)
+	}
+	return st, nil
+}
+
+// Object returns the object at index in the stream, which should have number
+// num. If it doesn't, because the xref is wrong, every object is checked.
+func (st *ObjectStream) Object(num, index int) (IndirectObject, bool) {
+	if index >= 0 && index < len(st.Objects) && st.Objects[index].Num == num {
+		return st.Objects[index], true
+	}
+	for _, o := range st.Objects {
+		if o.Num == num {
+			return o, true
+		}
+	}
+	return IndirectObject{}, false
+}
@@ -0,0 +1,157 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"strings"
+	"testing"
+)
+
+// objStm builds an object stream dict and Flate compressed body holding objs,
+// numbered from first.
+func objStm(t *testing.T, first int, objs ...string) (string, []byte) {
+	var hdr, body bytes.Buffer
+	for j, o := range objs {
+		fmt.Fprintf(&hdr, "%d %d ", first+j, body.Len())
+		body.WriteString(o)
+		body.WriteString("\n")
+	}
+	data, err := filters.Encode(append(hdr.Bytes(), body.Bytes()...), []filters.Filter{{Name: "FlateDecode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := fmt.Sprintf("<< /Type /ObjStm /N %d /First %d /Filter /FlateDecode /Length %d >>",
+		len(objs), hdr.Len(), len(data))
+	return dict, data
+}
+
+func TestDecodeObjectStream(t *testing.T) {
+	dict, data := objStm(t, 10, "<< /A 1 >>", "[1 2 3]", "(x)")
+	in := fmt.Sprintf("1 0 obj\n%s\nstream\n%s\nendstream\nendobj\n", dict, data)
+	o, err := NewObjectParser(NewLexer("", in)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := DecodeObjectStream(o.(IndirectObject).Value.(Stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Objects) != 3 {
+		t.Fatalf("want 3 objects, got %d", len(st.Objects))
+	}
+	for j, want := range []string{"<< /A 1 >>", "[1 2 3]", "(x)"} {
+		obj := st.Objects[j]
+		if obj.Num != 10+j || obj.Gen != 0 {
+			t.Fatalf("object %d has number %d %d", j, obj.Num, obj.Gen)
+		}
+		s := obj.Span()
+		if got := string(st.Data[s.Start:s.End]); got != want {
+			t.Fatalf("object %d: want span %q, got %q", j, want, got)
+		}
+	}
+	if n := st.Objects[0].Value.(Dict).Get("A").(Number); n.Int != 1 {
+		t.Fatalf("bad embedded dict %#v", n)
+	}
+	if obj, ok := st.Object(11, 0); !ok || obj.Num != 11 {
+		t.Fatalf("failed to find object 11 with the wrong index")
+	}
+	if _, ok := st.Object(13, 3); ok {
+		t.Fatalf("found missing object 13")
+	}
+}
+
+func TestDecodeObjectStreamErrors(t *testing.T) {
+	dict, data := objStm(t, 10, "<< /A 1 >>", "[1 2 3]")
+	for _, r := range []struct{ old, new string }{
+		{"/Type /ObjStm", "/Type /XRef"},
+		{"/N 2", "/N 3"},
+		{"/N 2", "/N -1"},
+		{"/First", "/Last"},
+		{"/First", "/First 9999 /Foo"},
+		{"/FlateDecode", "/DCTDecode"},
+	} {
+		in := fmt.Sprintf("1 0 obj\n%s\nstream\n%s\nendstream\nendobj\n", strings.Replace(dict, r.old, r.new, 1), data)
+		o, err := NewObjectParser(NewLexer("", in)).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DecodeObjectStream(o.(IndirectObject).Value.(Stream)); err == nil {
+			t.Fatalf("failed to detect error with %s", r.new)
+		}
+	}
+}
+
+func TestDecodeObjectStreamHugeOffset(t *testing.T) {
+	// The offset would overflow when added to /First
+	hdr := "10 9223372036854775800 "
+	data, err := filters.Encode([]byte(hdr+"<< /A 1 >>\n"), []filters.Filter{{Name: "FlateDecode"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := fmt.Sprintf("1 0 obj\n<< /Type /ObjStm /N 1 /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+		len(hdr), len(data), data)
+	o, err := NewObjectParser(NewLexer("", in)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeObjectStream(o.(IndirectObject).Value.(Stream)); err == nil {
+		t.Fatalf("failed to detect huge offset")
+	}
+}
+
+func TestResolveCompressed(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.5\n")
+	offs := make(map[int]int)
+	add := func(num int, s string) {
+		offs[num] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", num, s)
+	}
+	add(1, "<< /Type /Catalog /Pages 3 0 R >>")
+	dict, data := objStm(t, 3, "<< /Type /Pages /Kids [] /Count 0 >>", "(four)")
+	add(2, fmt.Sprintf("%s\nstream\n%s\nendstream", dict, data))
+
+	x := &xrefStream{w: [3]int{1, 2, 1}, index: []int{0, 6}}
+	offs[5] = b.Len()
+	xdata, err := x.encode([]xrefEntry{
+		{0, [3]int64{0, 0, 255}},
+		{1, [3]int64{1, int64(offs[1]), 0}},
+		{2, [3]int64{1, int64(offs[2]), 0}},
+		{3, [3]int64{2, 2, 0}},
+		{4, [3]int64{2, 2, 1}},
+		{5, [3]int64{1, int64(offs[5]), 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add(5, fmt.Sprintf("<< /Type /XRef /Size 6 /W [1 2 1] /Root 1 0 R /Length %d >>\nstream\n%s\nendstream",
+		len(xdata), xdata))
+	fmt.Fprintf(&b, "startxref\n%d\n%%%%EOF\n", offs[5])
+
+	d, err := Open(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := d.Resolve(d.Trailer.Get("Root").(Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err := d.Resolve(root.(Dict).Get("Pages").(Ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pages.(Dict).Get("Type").(Name).Value != "Pages" {
+		t.Fatalf("bad pages %#v", pages)
+	}
+	four, err := d.Resolve(Ref{Num: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(four.(String).Value) != "four" {
+		t.Fatalf("bad object 4 %#v", four)
+	}
+	if len(d.objStms) != 1 {
+		t.Fatalf("object stream was not cached")
+	}
+}
@@ -42,28 +42,54 @@ type Parser struct {
 	*Lexer
 	State   parseState
 	Scratch bytes.Buffer
+	defs    []objDef // every N G obj seen, in order
+	sig     [2]Item  // the last two significant items seen by MaybeFindXref
+	sigPos  [2]int   // where those items were written in Scratch
+	last    Item     // the most recent item read by the Parser
 }
 
-// Row represents one object entry in an xrefs section
+// errorf returns an *Error for item i, which is either a corrupt xref row
+// (ErrCorruptRow) or a state the Parser should never be in (ErrParserState).
+func (p *Parser) errorf(kind error, i Item, msg string) *Error {
+	e := newError(kind, i, "%s, got %v %q", msg, i.Typ, i.Val)
+	e.Name = p.name
+	return e
+}
+
+// objDef records where an object definition was written to Scratch.
+type objDef struct {
+	num, gen int
+	pos      int
+}
+
+// Row represents one object entry in an xrefs section, or in an xref stream.
+// Compressed rows only come from xref streams, and locate the object inside
+// an object stream instead of by Offset.
 type Row struct {
 	Offset     int
 	Generation int
 	Active     bool
+	Compressed bool
+	Stream     int // object number of the object stream, if Compressed
+	Index      int // index of the object in the object stream, if Compressed
 }
 
 // MaybeFindXref parses forward until it finds an xref token, emitting all seen
 // tokens to scratch. It is responsible for maintaining the 'LastXref' parser member
 // which records the start of the most recent xref section and the 'State'
 // struct member which is a sanity check to verify when we think we're in the
-// middle of parsing an xrefs.
-func (p *Parser) MaybeFindXref() bool {
+// middle of parsing an xrefs. It returns an error if it is called while still
+// inside an xref section.
+func (p *Parser) MaybeFindXref() (bool, error) {
 	if p.State == parseEOF {
-		return false
+		return false, nil
 	}
 	if p.State != outside {
-		panic("[BUG] MaybeFindXref() called while still in an xref")
+		return false, p.errorf(ErrParserState, p.last, "MaybeFindXref called while still in an xref")
 	}
-	for i := p.NextItem(); i.Typ != ItemEOF; i = p.NextItem() {
+	for i := p.Next(); i.Typ != ItemEOF; i = p.Next() {
+		p.last = i
+		p.record(i, p.Scratch.Len())
 		p.Scratch.WriteString(i.Val)
 		if i.Typ == ItemXref {
 			p.State = inside
@@ -72,16 +98,51 @@ func (p *Parser) MaybeFindXref() bool {
 			// "startxref\rNNNNNNN" string size they get out of sync in files
 			// with multiple xref sections
 			p.LastXref = p.Scratch.Len() - len(i.Val)
-			return true
+			return true, nil
 		}
 	}
 	p.State = parseEOF
-	return false
+	return false, nil
+}
+
+// record notes the Scratch position of every N G obj, so that xref rows can
+// be pointed at the right place.
+func (p *Parser) record(i Item, pos int) {
+	switch i.Typ {
+	case ItemSpace, ItemEOL, ItemComment:
+		return
+	case ItemObj:
+		if isObjNum(p.sig[0]) && isObjNum(p.sig[1]) {
+			n, _ := p.sig[0].Int()
+			g, _ := p.sig[1].Int()
+			p.defs = append(p.defs, objDef{int(n), int(g), p.sigPos[0]})
+		}
+	}
+	p.sig[0], p.sig[1] = p.sig[1], i
+	p.sigPos[0], p.sigPos[1] = p.sigPos[1], pos
+}
+
+// locate returns the Scratch position of the last definition of object num
+// with generation gen between From and LastXref, or -1 if there isn't one.
+func (p *Parser) locate(num, gen int) int {
+	for j := len(p.defs) - 1; j >= 0; j-- {
+		d := p.defs[j]
+		if d.pos >= p.LastXref {
+			continue
+		}
+		if d.pos < p.From {
+			break
+		}
+		if d.num == num && d.gen == gen {
+			return d.pos
+		}
+	}
+	return -1
 }
 
 // FindRow parses and consumes one object entry in an xref section. It does NOT
 // consume the trailing EOL marker. If the row is unable to be parsed, it will
-// emit all seen tokens to scratch before returning an error.
+// emit all seen tokens to scratch before returning an ErrCorruptRow *Error.
 func (p *Parser) FindRow() (r Row, e error) {
 	// Cache the contents of all tokens we evaluate so we can write them out if
 	// we have to abort
@@ -91,7 +152,7 @@ func (p *Parser) FindRow() (r Row, e error) {
 
 	bailout += i.Val
 	if !ok || len(i.Val) != 10 {
-		e = fmt.Errorf("corrupt row - want 10 digit offset, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want 10 digit offset")
 		p.Scratch.WriteString(bailout)
 		return
 	}
@@ -99,14 +160,14 @@ func (p *Parser) FindRow() (r Row, e error) {
 	if e != nil {
 		// Still need to handle errors - something like +12.5 will pass the
 		// lexer, but not Atoi
-		e = fmt.Errorf("corrupt row - want 10 digit offset, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want 10 digit offset")
 		return
 	}
 
 	i, ok = p.Accept(ItemSpace, false)
 	bailout += i.Val
 	if !ok || len(i.Val) != 1 {
-		e = fmt.Errorf("corrupt row - want ItemSpace, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want ItemSpace")
 		p.Scratch.WriteString(bailout)
 		return
 	}
@@ -114,20 +175,20 @@ func (p *Parser) FindRow() (r Row, e error) {
 	i, ok = p.Accept(ItemNumber, false)
 	bailout += i.Val
 	if !ok || len(i.Val) != 5 {
-		e = fmt.Errorf("corrupt row - want 5 digit generation, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want 5 digit generation")
 		p.Scratch.WriteString(bailout)
 		return
 	}
 	r.Generation, e = strconv.Atoi(i.Val)
 	if e != nil {
-		e = fmt.Errorf("corrupt row - 5 digit generation, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want 5 digit generation")
 		return
 	}
 
 	i, ok = p.Accept(ItemSpace, false)
 	bailout += i.Val
 	if !ok || len(i.Val) != 1 {
-		e = fmt.Errorf("corrupt row - want ItemSpace, got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want ItemSpace")
 		p.Scratch.WriteString(bailout)
 		return
 	}
@@ -135,7 +196,7 @@ func (p *Parser) FindRow() (r Row, e error) {
 	i, ok = p.Accept(ItemWord, false)
 	bailout += i.Val
 	if !ok || len(i.Val) != 1 || !(i.Val == "n" || i.Val == "f") {
-		e = fmt.Errorf("corrupt row - want [nf], got %#v", i)
+		e = p.errorf(ErrCorruptRow, i, "corrupt row - want [nf]")
 		p.Scratch.WriteString(bailout)
 		return
 	}
@@ -149,7 +210,8 @@ func (p *Parser) FindRow() (r Row, e error) {
 // itself and a match boolean. If write is true the token will be emitted to
 // scratch, whether or not the check matches.
 func (p *Parser) Accept(t ItemType, write bool) (Item, bool) {
-	i := p.NextItem()
+	i := p.Next()
+	p.last = i
 	if write {
 		p.Scratch.WriteString(i.Val)
 	}
@@ -192,13 +254,17 @@ func (p *Parser) SeemsLegit() bool {
 //   - fix the startxref offset
 //   - reset the state variables ready to find the next xref ( if any )
 //   - then return false.
-func (p *Parser) MaybeFindHeader() bool {
+//
+// It returns an error if it finds a header without having seen the xref
+// keyword first.
+func (p *Parser) MaybeFindHeader() (bool, error) {
 	if p.State != inside {
 		p.ResetToHere()
-		return false
+		return false, nil
 	}
 
-	i := p.NextItem()
+	i := p.Next()
+	p.last = i
 	p.Scratch.WriteString(i.Val)
 	var err error
 
@@ -211,13 +277,13 @@ func (p *Parser) MaybeFindHeader() bool {
 			i, atEOF := p.Accept(ItemEOF, true)
 			if atEOF {
 				p.State = parseEOF
-				return false
+				return false, nil
 			}
 
 			if i.Typ == ItemStartXref {
 				if _, ok := p.Accept(ItemEOL, true); !ok {
 					p.ResetToHere()
-					return false
+					return false, nil
 				}
 
 				// don't write in this call to Accept, we will write our
@@ -225,7 +291,7 @@ func (p *Parser) MaybeFindHeader() bool {
 				if i, ok := p.Accept(ItemNumber, false); !ok {
 					p.Scratch.WriteString(i.Val)
 					p.ResetToHere()
-					return false
+					return false, nil
 				}
 				p.Scratch.WriteString(fmt.Sprintf("%d", p.LastXref))
 
@@ -234,7 +300,7 @@ func (p *Parser) MaybeFindHeader() bool {
 				// them.
 
 				p.ResetToHere()
-				return false
+				return false, nil
 			}
 		}
 
@@ -242,23 +308,23 @@ func (p *Parser) MaybeFindHeader() bool {
 		p.Offset, err = strconv.Atoi(i.Val)
 		if err != nil {
 			p.ResetToHere()
-			return false
+			return false, nil
 		}
 
 		if _, ok := p.Accept(ItemSpace, true); !ok {
 			p.ResetToHere()
-			return false
+			return false, nil
 		}
 
 		i, ok := p.Accept(ItemNumber, true)
 		if !ok {
 			p.ResetToHere()
-			return false
+			return false, nil
 		}
 		p.Entries, err = strconv.Atoi(i.Val)
 		if err != nil {
 			p.ResetToHere()
-			return false
+			return false, nil
 		}
 
 		// Accept both 1 and 2 byte <EOL> as well as <SP><EOL>. Don't know if
@@ -266,26 +332,27 @@ func (p *Parser) MaybeFindHeader() bool {
 		i, ok = p.Accept(ItemEOL, true)
 		if !ok && i.Typ != ItemSpace {
 			p.ResetToHere()
-			return false
+			return false, nil
 		}
 		if i.Typ == ItemSpace {
 			// not CRLF, but it was SP ...we must get <EOL> now
 			if _, ok := p.Accept(ItemEOL, true); !ok {
 				p.ResetToHere()
-				return false
+				return false, nil
 			}
 		}
 
 		p.Idx = p.Offset
 		if !p.SeemsLegit() {
-			panic("BUG: logic broken in MaybeFindHeader")
+			p.ResetToHere()
+			return false, p.errorf(ErrParserState, i, "xref header found outside an xref")
 		}
 
-		return true
+		return true, nil
 
 	case ItemEOF:
 		p.State = parseEOF
-		return false
+		return false, nil
 	default:
 		// we assume that this was a truncated xref section or something, so
 		// we'll report no header row found, but still set the "from" index.
@@ -293,25 +360,32 @@ func (p *Parser) MaybeFindHeader() bool {
 		// be (hopefully correctly) from the end of this truncated / corrupt
 		// xref section to the start of the next one.
 		p.ResetToHere()
-		return false
+		return false, nil
 	}
 
 }
 
 // FixXrefs is a parsing loop. Essentially it seeks to an xref token, then
-// loops through parsing the xref header rows and object entry rows. When no
-// more xref tokens are found it runs through until the end of the file. This
-// consumes the supplied lexer, so it can only be used once.
-func (p *Parser) FixXrefs() []byte {
+// loops through parsing the xref header rows and object entry rows. Each in
+// use row is pointed at the last definition of that object, with the same
+// generation, between the previous xref section and this one. When no
+// more xref tokens are found it runs through until the end of the file, and
+// then fixes any xref streams as well. This consumes the supplied lexer, so
+// it can only be used once. Corrupt xref sections are left as they are, an
+// error is only returned if the Parser gets into an impossible state.
+func (p *Parser) FixXrefs() ([]byte, error) {
 mainLoop:
 	for {
-		found := p.MaybeFindXref()
+		found, err := p.MaybeFindXref()
+		if err != nil {
+			return nil, err
+		}
 		if !found {
 			if p.State != parseEOF {
 				// just checking...
-				panic("[BUG] No xref found but not at EOF!")
+				return nil, p.errorf(ErrParserState, p.last, "no xref found but not at EOF")
 			}
-			return p.Scratch.Bytes()
+			return fixXrefStreams(p.Scratch.Bytes()), nil
 		}
 
 		if _, ok := p.Accept(ItemEOL, true); !ok {
@@ -320,9 +394,16 @@ mainLoop:
 		}
 
 		// found a new xref section now
-		for p.MaybeFindHeader() {
+		for {
+			found, err := p.MaybeFindHeader()
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				break
+			}
 			if !p.SeemsLegit() {
-				panic("BUG: SeemsLegit() failed after we found a header!")
+				return nil, p.errorf(ErrParserState, p.last, "xref state invalid after finding a header")
 			}
 		entryLoop:
 			for i := 0; i < p.Entries; i++ {
@@ -333,15 +414,10 @@ mainLoop:
 				}
 
 				if row.Active {
-					objOffset := locateObj(p.Scratch.Bytes()[p.From:p.LastXref], p.Idx+i)
+					objOffset := p.locate(p.Idx+i, row.Generation)
 					// no matching object, emit the row unmodified
 					if objOffset < 0 {
 						objOffset = row.Offset
-					} else {
-						// If we found it in a subslice, add the from index to
-						// get the true index from the start of the input.
-						objOffset += p.From
-
 					}
 					p.Scratch.WriteString(fmt.Sprintf("%.10d %.5d n", objOffset, row.Generation))
 				} else {
@@ -374,15 +450,3 @@ mainLoop:
 		p.ResetToHere() // probably not neccessary, but idempotent
 	}
 }
-
-func locateObj(in []byte, i int) int {
-	idx := bytes.Index(in, []byte(fmt.Sprintf("\n%d 0 obj", i)))
-	if idx < 0 {
-		idx = bytes.Index(in, []byte(fmt.Sprintf("\r%d 0 obj", i)))
-		if idx < 0 {
-			return idx
-		}
-	}
-	// Add 1 to the offset so the index is ahead of the \n or \r
-	return idx + 1
-}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -278,22 +280,42 @@ func openVerify(tf testFile) ([]byte, error) {
 	return contents, nil
 }
 
-func fix(in []byte) []byte {
+func fix(t *testing.T, in []byte) []byte {
 	p := Parser{Lexer: NewLexer("", string(in))}
-	return p.FixXrefs()
+	out, err := p.FixXrefs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func findXref(t *testing.T, p *Parser) bool {
+	found, err := p.MaybeFindXref()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func findHeader(t *testing.T, p *Parser) bool {
+	found, err := p.MaybeFindHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
 }
 
 func TestCorruptFirstXref(t *testing.T) {
 	contents, err := openVerify(tfCorrupt)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
-	contents = fix(contents)
+	contents = fix(t, contents)
 
 	p := Parser{Lexer: NewLexer("", string(contents))}
 
 	// Find the first xref, make sure the parser is right about LastXref
-	if !p.MaybeFindXref() {
+	if !findXref(t, &p) {
 		t.Fatalf("failed to find first xref")
 	}
 	xridx := bytes.Index(contents, []byte("xref"))
@@ -306,7 +328,7 @@ func TestCorruptFirstXref(t *testing.T) {
 	}
 
 	// Find the first Header
-	if !p.MaybeFindHeader() {
+	if !findHeader(t, &p) {
 		t.Fatalf("failed to find first header")
 	}
 
@@ -332,7 +354,7 @@ func TestCorruptFirstXref(t *testing.T) {
 	p.ResetToHere()
 
 	// Find the second xref, make sure the parser is right about LastXref
-	if !p.MaybeFindXref() {
+	if !findXref(t, &p) {
 		t.Fatalf("failed to find second xref")
 	}
 	if _, ok := p.Accept(ItemEOL, true); !ok {
@@ -341,7 +363,7 @@ func TestCorruptFirstXref(t *testing.T) {
 	if p.LastXref != 21619 {
 		t.Fatalf("incorrect index for second xref. Want 21619, got %d", p.LastXref)
 	}
-	if !p.MaybeFindHeader() {
+	if !findHeader(t, &p) {
 		t.Fatalf("failed to find second header")
 	}
 	// Hardcoded
@@ -375,9 +397,9 @@ func TestCorruptFirstXref(t *testing.T) {
 func TestTruncate(t *testing.T) {
 	contents, err := openVerify(tfTruncate)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
-	contents = fix(contents)
+	contents = fix(t, contents)
 	// This is set to "9999999999 00000 n\r\n" in the testfile
 	want := "0000021142 00000 n\r\n"
 	got := string(contents[len(contents)-len(want):])
@@ -388,18 +410,18 @@ func TestTruncate(t *testing.T) {
 
 func TestXrefClean(t *testing.T) {
 	p := Parser{Lexer: NewLexer("", xrClean)}
-	if !p.MaybeFindXref() || p.LastXref != 0 {
+	if !findXref(t, &p) || p.LastXref != 0 {
 		t.Fatalf("failed to find xref")
 	}
 	p.Accept(ItemEOL, true)
-	if !p.MaybeFindHeader() {
+	if !findHeader(t, &p) {
 		t.Fatalf("failed to find header")
 	}
 	_, err := p.FindRow()
 	if err != nil {
 		t.Fatalf("failed to find row")
 	}
-	if p.MaybeFindHeader() {
+	if findHeader(t, &p) {
 		t.Fatalf("shouldn't have found a header")
 	}
 }
@@ -407,7 +429,10 @@ func TestXrefClean(t *testing.T) {
 func TestFixXrefs(t *testing.T) {
 	for _, fixErr := range fixErrors {
 		p := Parser{Lexer: NewLexer("", fixErr.input)}
-		out := p.FixXrefs()
+		out, err := p.FixXrefs()
+		if err != nil {
+			t.Fatal(err)
+		}
 		if string(out) != fixErr.input {
 			t.Fatalf("broken xref was modified by fix")
 		}
@@ -417,11 +442,11 @@ func TestFixXrefs(t *testing.T) {
 func TestFindRow(t *testing.T) {
 	for _, rowErr := range rowErrors {
 		p := Parser{Lexer: NewLexer("", rowErr.input)}
-		if !p.MaybeFindXref() || p.LastXref != 0 {
+		if !findXref(t, &p) || p.LastXref != 0 {
 			t.Fatalf("failed to find xref")
 		}
 		p.Accept(ItemEOL, true)
-		if !p.MaybeFindHeader() {
+		if !findHeader(t, &p) {
 			t.Fatalf("failed to find header")
 		}
 		_, err := p.FindRow()
@@ -434,11 +459,11 @@ func TestFindRow(t *testing.T) {
 func TestMaybeFindHeader(t *testing.T) {
 	for _, headerErr := range headerErrors {
 		p := Parser{Lexer: NewLexer("", headerErr.input)}
-		if !p.MaybeFindXref() || p.LastXref != 0 {
+		if !findXref(t, &p) || p.LastXref != 0 {
 			t.Fatalf("failed to find xref")
 		}
 		p.Accept(ItemEOL, true)
-		if !p.MaybeFindHeader() {
+		if !findHeader(t, &p) {
 			t.Fatalf("failed to find first header")
 		}
 		_, err := p.FindRow()
@@ -446,8 +471,70 @@ func TestMaybeFindHeader(t *testing.T) {
 			t.Fatalf("failed to find row")
 		}
 		p.Accept(ItemEOL, true)
-		if p.MaybeFindHeader() {
+		if findHeader(t, &p) {
 			t.Fatalf("failed to detect invalid header with %s", headerErr.desc)
 		}
 	}
 }
+
+func TestFixXrefsLocate(t *testing.T) {
+	// Object 1 has no EOL before it, 2 has a non-zero generation and follows
+	// a space, 3 follows a comment and is defined twice.
+	in := "1 0 obj (one) endobj 2 5 obj (two) endobj\n" +
+		"%c\n3 0 obj (old) endobj\n3 0 obj (new) endobj\n" +
+		"xref\n0 4\n" +
+		"0000000000 65535 f \n" +
+		"0000000099 00000 n \n" +
+		"0000000099 00005 n \n" +
+		"0000000099 00000 n \n" +
+		"trailer\n<< /Size 4 >>\nstartxref\n999\n%%EOF\n"
+	out := string(fix(t, []byte(in)))
+	for _, want := range []string{
+		"0000000000 00000 n",
+		"0000000021 00005 n",
+		"0000000066 00000 n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing fixed row %q in\n%s", want, out)
+		}
+	}
+
+	// A row with the wrong generation is left alone
+	in = strings.Replace(in, "2 5 obj", "2 4 obj", 1)
+	out = string(fix(t, []byte(in)))
+	if !strings.Contains(out, "0000000099 00005 n") {
+		t.Fatalf("row with no matching generation was modified\n%s", out)
+	}
+}
+
+func TestParserStateErrors(t *testing.T) {
+	p := Parser{Lexer: NewLexer("", xrClean)}
+	if !findXref(t, &p) {
+		t.Fatalf("failed to find xref")
+	}
+	_, err := p.MaybeFindXref()
+	var e *Error
+	if !errors.Is(err, ErrParserState) || !errors.As(err, &e) || e.Item.Typ != ItemXref {
+		t.Fatalf("want ErrParserState at the xref, got %v", err)
+	}
+
+	_, err = p.FindRow()
+	if !errors.Is(err, ErrCorruptRow) || !errors.As(err, &e) || e.Pos != p.LastPos() {
+		t.Fatalf("want ErrCorruptRow for a corrupt row, got %v", err)
+	}
+}
+
+func FuzzFixXrefs(f *testing.F) {
+	f.Add(xrClean)
+	f.Add(pdf)
+	for _, fixErr := range fixErrors {
+		f.Add(fixErr.input)
+	}
+	f.Fuzz(func(t *testing.T, in string) {
+		p := Parser{Lexer: NewLexer("", in)}
+		out, err := p.FixXrefs()
+		if err == nil && out == nil && len(in) > 0 {
+			t.Fatalf("no output and no error")
+		}
+	})
+}
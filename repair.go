@@ -0,0 +1,323 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"sort"
+	"strings"
+)
+
+// When the xref is missing or too broken to fix in place, viewers fall back
+// to scanning the whole file for N G obj headers and building their own
+// index. Repair does the same, but writes the index out as a new xref
+// section appended to the file, so that every other reader agrees with it.
+// Nothing in the original input is moved or modified.
+
+// RepairReport describes what Repair found and wrote.
+type RepairReport struct {
+	Objects    int  // object definitions found by scanning
+	Redefined  int  // definitions hidden by a later one with the same number
+	Compressed int  // objects found in object streams
+	Root       Ref  // the document catalog
+	Catalog    bool // Root was found by its /Type, not taken from an old trailer
+	XrefStream bool // an xref stream was written, because there were object streams
+	Xref       int  // offset of the new xref section
+	Size       int  // /Size of the new trailer
+}
+
+func (r *RepairReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "found %d objects", r.Objects)
+	if r.Redefined > 0 {
+		fmt.Fprintf(&b, " (%d redefined)", r.Redefined)
+	}
+	if r.Compressed > 0 {
+		fmt.Fprintf(&b, ", %d in object streams", r.Compressed)
+	}
+	from := "old trailer"
+	if r.Catalog {
+		from = "catalog"
+	}
+	kind := "table"
+	if r.XrefStream {
+		kind = "stream"
+	}
+	fmt.Fprintf(&b, ", /Root %d %d R from %s, new xref %s at %d with /Size %d",
+		r.Root.Num, r.Root.Gen, from, kind, r.Xref, r.Size)
+	return b.String()
+}
+
+// objectAt parses the indirect object between pos and end.
+func objectAt(in []byte, pos, end Pos) (IndirectObject, error) {
+	p := NewObjectParser(newLexerAt("", bytes.NewReader(in[pos:end]), pos))
+	o, err := p.Next()
+	if err != nil {
+		return IndirectObject{}, err
+	}
+	obj, ok := o.(IndirectObject)
+	if !ok {
+		return IndirectObject{}, fmt.Errorf("no object at pos %d", pos)
+	}
+	return obj, nil
+}
+
+// hasType reports whether o is a dict, or the dict of a stream, with the
+// given /Type.
+func hasType(o Object, typ string) bool {
+	if s, ok := o.(Stream); ok {
+		o = s.Dict
+	}
+	d, ok := o.(Dict)
+	if !ok {
+		return false
+	}
+	n, ok := d.Get("Type").(Name)
+	return ok && n.Value == typ
+}
+
+// Repair scans in for every N G obj and appends a new xref section and
+// trailer that index them all. Where an object is defined more than once the
+// last definition wins, and direct definitions win over objects in object
+// streams. /Root is the last object with /Type /Catalog, or if there isn't
+// one, the /Root of the last trailer that can be parsed. /Info, /ID and
+// /Encrypt are also copied from that trailer. If any object streams are
+// found the new section is an xref stream, otherwise it is a classic table.
+func Repair(in []byte) ([]byte, *RepairReport, error) {
+	rep := &RepairReport{}
+	marks := scanMarks(in)
+
+	rows := make(map[int]Row)
+	var objs []xrefMark
+	for _, m := range marks {
+		if m.Typ != ItemObj {
+			continue
+		}
+		rep.Objects++
+		if _, ok := rows[m.Num]; ok {
+			rep.Redefined++
+		}
+		rows[m.Num] = Row{Offset: int(m.Pos), Generation: m.Gen, Active: true}
+		objs = append(objs, m)
+	}
+	if len(objs) == 0 {
+		return nil, nil, fmt.Errorf("no objects found")
+	}
+
+	// Only objects that mention /Catalog or /ObjStm are worth parsing.
+	compressed := make(map[int]Row)
+	for j, m := range objs {
+		end := Pos(len(in))
+		if j+1 < len(objs) {
+			end = objs[j+1].Pos
+		}
+		if rows[m.Num].Offset != int(m.Pos) {
+			continue
+		}
+		text := in[m.Pos:end]
+		if !bytes.Contains(text, []byte("/Catalog")) && !bytes.Contains(text, []byte("/ObjStm")) {
+			continue
+		}
+		obj, err := objectAt(in, m.Pos, end)
+		if err != nil {
+			continue
+		}
+		if hasType(obj.Value, "Catalog") {
+			rep.Root, rep.Catalog = Ref{Num: obj.Num, Gen: obj.Gen}, true
+		}
+		s, ok := obj.Value.(Stream)
+		if !ok || !hasType(s, "ObjStm") {
+			continue
+		}
+		st, err := DecodeObjectStream(s)
+		if err != nil {
+			continue
+		}
+		for idx, o := range st.Objects {
+			compressed[o.Num] = Row{Active: true, Compressed: true, Stream: obj.Num, Index: idx}
+			if hasType(o.Value, "Catalog") {
+				rep.Root, rep.Catalog = Ref{Num: o.Num}, true
+			}
+		}
+	}
+	for num, r := range compressed {
+		if _, ok := rows[num]; !ok {
+			rows[num] = r
+			rep.Compressed++
+			rep.XrefStream = true
+		}
+	}
+
+	extra := ""
+	if t, ok := lastTrailer(in, marks); ok {
+		if r, ok := t.Get("Root").(Ref); ok && !rep.Catalog {
+			rep.Root = r
+		}
+		if r, ok := t.Get("Info").(Ref); ok && rows[r.Num].Active {
+			extra += fmt.Sprintf(" /Info %d %d R", r.Num, r.Gen)
+		}
+		switch e := t.Get("Encrypt").(type) {
+		case Ref:
+			if rows[e.Num].Active {
+				extra += fmt.Sprintf(" /Encrypt %d %d R", e.Num, e.Gen)
+			}
+		case Dict:
+			var b bytes.Buffer
+			if err := (&Writer{}).object(&b, e); err == nil {
+				extra += " /Encrypt " + b.String()
+			}
+		}
+		if id, ok := t.Get("ID").(Array); ok && len(id.Elems) == 2 {
+			a, aok := id.Elems[0].(String)
+			b, bok := id.Elems[1].(String)
+			if aok && bok {
+				extra += fmt.Sprintf(" /ID [%s %s]", a.Raw, b.Raw)
+			}
+		}
+	}
+	if !rows[rep.Root.Num].Active {
+		return nil, nil, fmt.Errorf("no document catalog found")
+	}
+
+	size := 0
+	for num := range rows {
+		if num >= size {
+			size = num + 1
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write(in)
+	if len(in) > 0 && in[len(in)-1] != '\n' && in[len(in)-1] != '\r' {
+		out.WriteString("\n")
+	}
+	rep.Xref = out.Len()
+	if rep.XrefStream {
+		// The xref stream needs an entry for itself
+		rows[size] = Row{Offset: rep.Xref, Active: true}
+		size++
+		rep.Size = size
+		body, w, index, err := encodeRows(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(index) > 2 {
+			a := Array{}
+			for _, n := range index {
+				a.Elems = append(a.Elems, intNumber(n))
+			}
+			var b bytes.Buffer
+			if err := (&Writer{}).object(&b, a); err != nil {
+				return nil, nil, err
+			}
+			extra += " /Index " + b.String()
+		}
+		fmt.Fprintf(&out, "%d 0 obj\n<< /Type /XRef /Size %d /W [%d %d %d] /Root %d %d R%s /Filter /FlateDecode /Length %d >>\nstream\n",
+			size-1, size, w[0], w[1], w[2], rep.Root.Num, rep.Root.Gen, extra, len(body))
+		out.Write(body)
+		out.WriteString("\nendstream\nendobj\n")
+	} else {
+		rep.Size = size
+		out.WriteString("xref\n")
+		index := subsections(rows)
+		for j := 0; j < len(index); j += 2 {
+			fmt.Fprintf(&out, "%d %d\n", index[j], index[j+1])
+			for num := index[j]; num < index[j]+index[j+1]; num++ {
+				if r, ok := rows[num]; ok {
+					fmt.Fprintf(&out, "%.10d %.5d n\r\n", r.Offset, r.Generation)
+				} else {
+					out.WriteString("0000000000 65535 f\r\n")
+				}
+			}
+		}
+		fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d %d R%s >>\n", size, rep.Root.Num, rep.Root.Gen, extra)
+	}
+	fmt.Fprintf(&out, "startxref\n%d\n%%%%EOF\n", rep.Xref)
+	return out.Bytes(), rep, nil
+}
+
+// subsections returns the object numbers in rows, and 0 for the head of the
+// free list, as pairs of first number and count of consecutive numbers. Only
+// numbers that were found get a row, so a single stray huge object number
+// doesn't mean writing a row for every number below it.
+func subsections(rows map[int]Row) []int {
+	nums := []int{0}
+	for num := range rows {
+		if num != 0 {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	var index []int
+	for j, num := range nums {
+		if j > 0 && num == nums[j-1]+1 {
+			index[len(index)-1]++
+			continue
+		}
+		index = append(index, num, 1)
+	}
+	return index
+}
+
+// encodeRows builds a Flate compressed xref stream body for the objects in
+// rows, returning it along with the /W and /Index it needs. Object 0 is the
+// head of the free list if rows doesn't have it.
+func encodeRows(rows map[int]Row) ([]byte, [3]int, []int, error) {
+	index := subsections(rows)
+	var entries []xrefEntry
+	var widest [3]int64
+	for j := 0; j < len(index); j += 2 {
+		for num := index[j]; num < index[j]+index[j+1]; num++ {
+			e := xrefEntry{num: num, fields: [3]int64{0, 0, 65535}}
+			if r, ok := rows[num]; ok {
+				switch {
+				case r.Compressed:
+					e.fields = [3]int64{2, int64(r.Stream), int64(r.Index)}
+				case r.Active:
+					e.fields = [3]int64{1, int64(r.Offset), int64(r.Generation)}
+				default:
+					e.fields = [3]int64{0, int64(r.Offset), int64(r.Generation)}
+				}
+			}
+			for f, v := range e.fields {
+				if v > widest[f] {
+					widest[f] = v
+				}
+			}
+			entries = append(entries, e)
+		}
+	}
+	x := &xrefStream{chain: []filters.Filter{{Name: "FlateDecode"}}}
+	for f, v := range widest {
+		x.w[f] = 1
+		for v > 0xff {
+			x.w[f]++
+			v >>= 8
+		}
+	}
+	body, err := x.encode(entries)
+	return body, x.w, index, err
+}
+
+// lastTrailer returns the last trailer dict, or xref stream dict, that can be
+// parsed.
+func lastTrailer(in []byte, marks []xrefMark) (Dict, bool) {
+	var t Dict
+	found := false
+	at := -1
+	if idx := bytes.LastIndex(in, []byte("trailer")); idx >= 0 {
+		p := NewObjectParser(NewLexer("", string(in[idx+len("trailer"):])))
+		if o, err := p.ParseObject(); err == nil {
+			t, found = o.(Dict)
+			at = idx
+		}
+	}
+	streams := xrefStreams(in, marks)
+	if len(streams) > 0 {
+		last := streams[len(streams)-1]
+		if int(marks[last.at].Pos) > at {
+			t, found = last.s.Dict, true
+		}
+	}
+	return t, found
+}
@@ -0,0 +1,167 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func repairOpen(t *testing.T, in string) (*Document, *RepairReport, []byte) {
+	out, rep, err := Repair([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte(in)) {
+		t.Fatalf("original input was modified")
+	}
+	d, err := Open(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("repaired file doesn't open: %s\n%s", err, out[len(in):])
+	}
+	if d.StartXref != rep.Xref {
+		t.Fatalf("want startxref %d, got %d", rep.Xref, d.StartXref)
+	}
+	return d, rep, out
+}
+
+func TestRepair(t *testing.T) {
+	// no xref or trailer at all
+	in := pdf[:strings.Index(pdf, "xref")]
+	d, rep, _ := repairOpen(t, in)
+	if rep.Objects != 4 || rep.Redefined != 0 || rep.Compressed != 0 || rep.XrefStream {
+		t.Fatalf("bad report %s", rep)
+	}
+	if !rep.Catalog || rep.Root.Num != 1 || rep.Size != 5 {
+		t.Fatalf("bad report %s", rep)
+	}
+	for num, want := range []int{0, 18, 77, 178, 457} {
+		if r := d.Xref[num]; num > 0 && (r.Offset != want || !r.Active) {
+			t.Fatalf("bad row for object %d %#v", num, r)
+		}
+	}
+	root, err := d.Resolve(d.Trailer.Get("Root").(Ref))
+	if err != nil || !hasType(root, "Catalog") {
+		t.Fatalf("bad root %#v %v", root, err)
+	}
+}
+
+func TestRepairGarbageXref(t *testing.T) {
+	in := strings.Replace(pdf, "0000000077 00000 n", "garbage garbage", 1)
+	in = strings.Replace(in, "/Root 1 0 R", "/Root 1 0 R /Info 3 0 R /ID [<01> <02>]", 1)
+	d, rep, out := repairOpen(t, in)
+	if rep.Xref <= len(pdf) {
+		t.Fatalf("new xref at %d, is not appended", rep.Xref)
+	}
+	if d.Xref[2].Offset != 77 {
+		t.Fatalf("bad row for object 2 %#v", d.Xref[2])
+	}
+	if !bytes.Contains(out[rep.Xref:], []byte("/Info 3 0 R /ID [<01> <02>]")) {
+		t.Fatalf("/Info and /ID weren't kept:\n%s", out[rep.Xref:])
+	}
+}
+
+func TestRepairDirectEncrypt(t *testing.T) {
+	e := "<< /Filter /Standard /V 1 /R 2 /O <00> /U <00> /P -4 >>"
+	in := strings.Replace(pdf, "/Root 1 0 R", "/Root 1 0 R /Encrypt "+e, 1)
+	in = strings.Replace(in, "0000000077 00000 n", "garbage garbage", 1)
+	d, rep, out := repairOpen(t, in)
+	if !bytes.Contains(out[rep.Xref:], []byte("/Encrypt "+e)) {
+		t.Fatalf("direct /Encrypt wasn't kept:\n%s", out[rep.Xref:])
+	}
+	if !d.Encrypted() {
+		t.Fatalf("repaired file isn't encrypted")
+	}
+}
+
+func TestRepairRedefined(t *testing.T) {
+	in := update(pdf)
+	in = strings.Replace(in, "4 0 obj\n<< /Length 5", "4 1 obj\n<< /Length 5", 1)
+	in = in[:strings.LastIndex(in, "xref")]
+	d, rep, _ := repairOpen(t, in)
+	if rep.Objects != 6 || rep.Redefined != 1 {
+		t.Fatalf("bad report %s", rep)
+	}
+	if d.Xref[4].Generation != 1 {
+		t.Fatalf("want generation 1 for object 4, got %#v", d.Xref[4])
+	}
+	o, err := d.Resolve(Ref{Num: 4, Gen: 1})
+	if err != nil || string(o.(Stream).Raw) != "hello" {
+		t.Fatalf("bad object 4 %#v %v", o, err)
+	}
+}
+
+func TestRepairObjectStream(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("%PDF-1.5\n")
+	dict, data := objStm(t, 1, "<< /Type /Catalog /Pages 2 0 R >>", "<< /Type /Pages /Kids [] /Count 0 >>")
+	fmt.Fprintf(&b, "3 0 obj\n%s\nstream\n%s\nendstream\nendobj\n", dict, data)
+	b.WriteString("2 0 obj\n(direct wins)\nendobj\n")
+
+	d, rep, _ := repairOpen(t, b.String())
+	if rep.Objects != 2 || rep.Compressed != 1 || !rep.XrefStream || !rep.Catalog || rep.Size != 5 {
+		t.Fatalf("bad report %s", rep)
+	}
+	if r := d.Xref[1]; !r.Compressed || r.Stream != 3 || r.Index != 0 {
+		t.Fatalf("bad row for object 1 %#v", r)
+	}
+	if r := d.Xref[4]; r.Offset != rep.Xref {
+		t.Fatalf("bad row for the xref stream %#v", r)
+	}
+	o, err := d.Resolve(Ref{Num: 2})
+	if err != nil || string(o.(String).Value) != "direct wins" {
+		t.Fatalf("bad object 2 %#v %v", o, err)
+	}
+	root, err := d.Resolve(d.Trailer.Get("Root").(Ref))
+	if err != nil || !hasType(root, "Catalog") {
+		t.Fatalf("bad root %#v %v", root, err)
+	}
+}
+
+func TestRepairRootFromTrailer(t *testing.T) {
+	in := strings.Replace(pdf, "/Type /Catalog", "/Type /Katalog", 1)
+	_, rep, _ := repairOpen(t, in)
+	if rep.Catalog || rep.Root.Num != 1 {
+		t.Fatalf("bad report %s", rep)
+	}
+}
+
+func TestRepairHugeObjectNumber(t *testing.T) {
+	// One stray object number mustn't mean a row for every number below it
+	stray := "900000000 0 obj\n(stray)\nendobj\n"
+	table := pdf[:strings.Index(pdf, "xref")] + stray
+	dict, data := objStm(t, 1, "<< /Type /Catalog >>")
+	stream := fmt.Sprintf("%%PDF-1.5\n3 0 obj\n%s\nstream\n%s\nendstream\nendobj\n%s", dict, data, stray)
+
+	for _, in := range []string{table, stream} {
+		d, rep, out := repairOpen(t, in)
+		if len(out)-len(in) > 1024 {
+			t.Fatalf("new xref section is %d bytes", len(out)-len(in))
+		}
+		if rep.Size < 900000001 {
+			t.Fatalf("bad report %s", rep)
+		}
+		if rep.XrefStream && !bytes.Contains(out, []byte("/Index [0 2 3 1 900000000 2]")) {
+			t.Fatalf("bad /Index in\n%s", out[rep.Xref:])
+		}
+		o, err := d.Resolve(Ref{Num: 900000000})
+		if err != nil || string(o.(String).Value) != "stray" {
+			t.Fatalf("bad stray object %#v %v", o, err)
+		}
+		if root, err := d.Resolve(d.Trailer.Get("Root").(Ref)); err != nil || !hasType(root, "Catalog") {
+			t.Fatalf("bad root %#v %v", root, err)
+		}
+	}
+}
+
+func TestRepairErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"%PDF-1.1\n%%EOF\n",
+		"%PDF-1.1\n1 0 obj\n(no catalog)\nendobj\n",
+	} {
+		if _, _, err := Repair([]byte(in)); err == nil {
+			t.Fatalf("failed to detect error in %q", in)
+		}
+	}
+}
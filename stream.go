@@ -0,0 +1,96 @@
+package pdflex
+
+import (
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+)
+
+// Spec: 7.3.8.2, 7.4
+// A stream's /Filter is a name or an array of names, applied in order to
+// decode the data. /DecodeParms is then a dict, or an array of dicts and
+// nulls with one element per filter.
+
+// Filters returns the filter chain of s, from its /Filter and /DecodeParms,
+// in decoding order.
+func (s Stream) Filters() ([]filters.Filter, error) {
+	return dictFilters(s.Dict)
+}
+
+// Decode returns the decoded contents of s. If the body is damaged part way
+// through, what could be decoded is returned along with the error.
+func (s Stream) Decode() ([]byte, error) {
+	chain, err := s.Filters()
+	if err != nil {
+		return nil, err
+	}
+	return filters.Decode(s.Raw, chain)
+}
+
+// Encode returns data encoded with the filter chain of s, ready to replace
+// its body. The /Length of s isn't changed.
+func (s Stream) Encode(data []byte) ([]byte, error) {
+	chain, err := s.Filters()
+	if err != nil {
+		return nil, err
+	}
+	return filters.Encode(data, chain)
+}
+
+// dictFilters reads the /Filter and /DecodeParms entries of a stream dict.
+func dictFilters(d Dict) ([]filters.Filter, error) {
+	var names, parms []Object
+	switch f := d.Get("Filter").(type) {
+	case nil:
+		return nil, nil
+	case Name:
+		names = []Object{f}
+		parms = []Object{d.Get("DecodeParms")}
+	case Array:
+		names = f.Elems
+		if a, ok := d.Get("DecodeParms").(Array); ok {
+			parms = a.Elems
+		}
+	default:
+		return nil, fmt.Errorf("/Filter is not a name or array")
+	}
+
+	chain := make([]filters.Filter, len(names))
+	for j, o := range names {
+		n, ok := o.(Name)
+		if !ok {
+			return nil, fmt.Errorf("/Filter array has a non name element")
+		}
+		chain[j].Name = n.Value
+		if j >= len(parms) {
+			continue
+		}
+		switch p := parms[j].(type) {
+		case Dict:
+			chain[j].Params = decodeParms(p)
+		case nil, Null:
+		default:
+			return nil, fmt.Errorf("/DecodeParms for %s is not a dict", n.Raw)
+		}
+	}
+	return chain, nil
+}
+
+// decodeParms keeps the integer and boolean entries of a /DecodeParms dict,
+// with booleans as 0 or 1.
+func decodeParms(d Dict) filters.Params {
+	p := make(filters.Params)
+	for _, e := range d.Entries {
+		switch v := e.Value.(type) {
+		case Number:
+			if v.IsInt {
+				p[e.Key.Value] = int(v.Int)
+			}
+		case Bool:
+			p[e.Key.Value] = 0
+			if v.Value {
+				p[e.Key.Value] = 1
+			}
+		}
+	}
+	return p
+}
@@ -0,0 +1,75 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"testing"
+)
+
+// parseStream parses a stream object with the given dict entries and raw body.
+func parseStream(t *testing.T, entries string, raw []byte) Stream {
+	in := fmt.Sprintf("1 0 obj\n<< %s /Length %d >>\nstream\n%s\nendstream\nendobj\n", entries, len(raw), raw)
+	o, err := NewObjectParser(NewLexer("", in)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o.(IndirectObject).Value.(Stream)
+}
+
+func TestStreamFilters(t *testing.T) {
+	s := parseStream(t, "/Filter [/AHx /FlateDecode] /DecodeParms [null << /Predictor 12 /Columns 3 /Foo true >>]", nil)
+	chain, err := s.Filters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].Name != "AHx" || chain[0].Params != nil || chain[1].Name != "FlateDecode" {
+		t.Fatalf("bad chain %#v", chain)
+	}
+	if p := chain[1].Params; p["Predictor"] != 12 || p["Columns"] != 3 || p["Foo"] != 1 {
+		t.Fatalf("bad params %#v", p)
+	}
+
+	for _, entries := range []string{
+		"/Filter 1",
+		"/Filter [/FlateDecode 1]",
+		"/Filter /FlateDecode /DecodeParms 1",
+	} {
+		if _, err := parseStream(t, entries, nil).Filters(); err == nil {
+			t.Fatalf("failed to detect error with %s", entries)
+		}
+	}
+}
+
+func TestStreamDecode(t *testing.T) {
+	want := bytes.Repeat([]byte("0 0 1 rg 10 10 100 100 re f\n"), 20)
+	chain := []filters.Filter{{Name: "ASCII85Decode"}, {Name: "LZWDecode"}}
+	raw, err := filters.Encode(want, chain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := parseStream(t, "/Filter [/ASCII85Decode /LZWDecode]", raw)
+	got, err := s.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("bad decode %q", got)
+	}
+	again, err := s.Encode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, raw) {
+		t.Fatalf("re-encoding changed the body")
+	}
+
+	s = parseStream(t, "", []byte("plain"))
+	if got, err := s.Decode(); err != nil || string(got) != "plain" {
+		t.Fatalf("bad unfiltered decode %q %v", got, err)
+	}
+	s = parseStream(t, "/Filter /JPXDecode", []byte("x"))
+	if _, err := s.Decode(); err == nil {
+		t.Fatalf("failed to detect unsupported filter")
+	}
+}
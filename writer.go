@@ -0,0 +1,300 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Spec: 7.5.2, 7.5.4, 7.5.5
+// A file starts with the %PDF-n.n header, followed by a comment with at least
+// four bytes over 127 so that transfer programs treat it as binary. After the
+// objects comes the xref table, one 20 byte row per object number from 0 to
+// /Size - 1, then the trailer, startxref and %%EOF. Free rows form a linked
+// list through their offset fields, starting and ending at object 0, which
+// has generation 65535.
+
+// binaryComment follows the header.
+const binaryComment = "%\xe2\xe3\xcf\xd3\n"
+
+// trailerOnly are trailer and xref stream entries that describe the xref
+// section they came from, so they aren't copied to a new one.
+var trailerOnly = map[string]bool{
+	"Size": true, "Prev": true, "XRefStm": true, "Type": true, "W": true,
+	"Index": true, "Filter": true, "DecodeParms": true, "Length": true,
+}
+
+// Writer writes indirect objects out as a complete PDF file. By default
+// names, strings and numbers are written with their original spelling, from
+// their Raw fields, so a parsed file comes back out token for token, apart
+// from whitespace and stream /Lengths. Objects built by hand, with no Raw,
+// are spelled as in Normalize mode.
+//
+// Objects from Document.Resolve are already decrypted. To write an encrypted
+// document back out encrypted, set Crypt, usually to Document.Crypt, and
+// Encrypt to the /Encrypt reference of the trailer, so that the /Encrypt dict
+// itself is left alone. Without a Crypt, /Encrypt is dropped from the trailer
+// and the file is written decrypted.
+type Writer struct {
+	Normalize  bool   // respell every name, string and number canonically
+	XrefStream bool   // write a compressed xref stream instead of a table
+	Version    string // for the header, "1.7" if empty
+	Crypt      *Crypt // encrypts every string and stream, if set
+	Encrypt    Ref    // the /Encrypt dict, which isn't encrypted
+	w          io.Writer
+	pos        int
+	rows       map[int]Row
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w, rows: make(map[int]Row)}
+}
+
+// header writes the header, if nothing has been written yet.
+func (w *Writer) header() error {
+	if w.pos > 0 {
+		return nil
+	}
+	v := w.Version
+	if v == "" {
+		v = "1.7"
+	}
+	return w.write([]byte("%PDF-" + v + "\n" + binaryComment))
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.pos += n
+	return err
+}
+
+// WriteObject writes o. If an object number is written more than once, the
+// xref points to the last one.
+func (w *Writer) WriteObject(o IndirectObject) error {
+	v := o.Value
+	if w.Crypt != nil && o.Num != w.Encrypt.Num {
+		var err error
+		if v, err = w.Crypt.Encrypt(o.Num, o.Gen, v); err != nil {
+			return fmt.Errorf("object %d %d: %s", o.Num, o.Gen, err)
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d %d obj\n", o.Num, o.Gen)
+	if err := w.object(&b, v); err != nil {
+		return fmt.Errorf("object %d %d: %s", o.Num, o.Gen, err)
+	}
+	b.WriteString("\nendobj\n")
+	if err := w.header(); err != nil {
+		return err
+	}
+	w.rows[o.Num] = Row{Offset: w.pos, Generation: o.Gen, Active: true}
+	return w.write(b.Bytes())
+}
+
+// WriteTrailer ends the file with an xref section covering every object
+// written, the trailer and startxref. Entries are copied from trailer, which
+// would usually be Document.Trailer, apart from /Size, which is computed, and
+// /Prev, /XRefStm and any xref stream entries. /Encrypt is only copied when
+// the Writer has a Crypt.
+func (w *Writer) WriteTrailer(trailer Dict) error {
+	if err := w.header(); err != nil {
+		return err
+	}
+	if w.Crypt != nil && trailer.Get("Encrypt") == nil {
+		return fmt.Errorf("trailer has no /Encrypt for the Crypt")
+	}
+	size := 0
+	for num := range w.rows {
+		if num >= size {
+			size = num + 1
+		}
+	}
+	t := Dict{}
+	for _, e := range trailer.Entries {
+		if !trailerOnly[e.Key.Value] && (e.Key.Value != "Encrypt" || w.Crypt != nil) {
+			t.Entries = append(t.Entries, e)
+		}
+	}
+
+	if w.XrefStream {
+		// The xref stream needs an entry for itself
+		xref := w.pos
+		w.rows[size] = Row{Offset: xref, Active: true}
+		size++
+		body, wd, _, err := encodeRows(w.freeList(size))
+		if err != nil {
+			return err
+		}
+		d := Dict{Entries: []DictEntry{
+			{Name{Value: "Type"}, Name{Value: "XRef"}},
+			{Name{Value: "Size"}, intNumber(size)},
+			{Name{Value: "W"}, Array{Elems: []Object{intNumber(wd[0]), intNumber(wd[1]), intNumber(wd[2])}}},
+		}}
+		d.Entries = append(d.Entries, t.Entries...)
+		d.Entries = append(d.Entries, DictEntry{Name{Value: "Filter"}, Name{Value: "FlateDecode"}})
+		if err := w.WriteObject(IndirectObject{Num: size - 1, Value: Stream{Dict: d, Raw: body}}); err != nil {
+			return err
+		}
+		return w.write([]byte(fmt.Sprintf("startxref\n%d\n%%%%EOF\n", xref)))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "xref\n0 %d\n", size)
+	rows := w.freeList(size)
+	for num := 0; num < size; num++ {
+		r := rows[num]
+		kind := 'f'
+		if r.Active {
+			kind = 'n'
+		}
+		fmt.Fprintf(&b, "%.10d %.5d %c\r\n", r.Offset, r.Generation, kind)
+	}
+	b.WriteString("trailer\n")
+	t.Entries = append([]DictEntry{{Name{Value: "Size"}, intNumber(size)}}, t.Entries...)
+	if err := w.object(&b, t); err != nil {
+		return fmt.Errorf("trailer: %s", err)
+	}
+	fmt.Fprintf(&b, "\nstartxref\n%d\n%%%%EOF\n", w.pos)
+	return w.write(b.Bytes())
+}
+
+// freeList returns a row for every object number below size. Numbers that
+// weren't written are free, and linked together through their offsets.
+func (w *Writer) freeList(size int) map[int]Row {
+	rows := make(map[int]Row, size)
+	var free []int
+	for num := 0; num < size; num++ {
+		if r, ok := w.rows[num]; ok && num > 0 {
+			rows[num] = r
+		} else {
+			free = append(free, num)
+		}
+	}
+	for j, num := range free {
+		next := 0
+		if j+1 < len(free) {
+			next = free[j+1]
+		}
+		r := Row{Offset: next}
+		if num == 0 {
+			r.Generation = 65535
+		}
+		rows[num] = r
+	}
+	return rows
+}
+
+func intNumber(n int) Number {
+	return Number{IsInt: true, Int: int64(n), Float: float64(n)}
+}
+
+// object writes the spelling of o to b. A stream's /Length is set to the
+// length of its Raw data.
+func (w *Writer) object(b *bytes.Buffer, o Object) error {
+	switch v := o.(type) {
+	case Name:
+		if v.Raw == "" || w.Normalize {
+			b.WriteString(spellName(v.Value))
+		} else {
+			b.WriteString(v.Raw)
+		}
+	case String:
+		switch {
+		case v.Raw != "" && !w.Normalize:
+			b.WriteString(v.Raw)
+		case w.Normalize:
+			b.WriteString(spellString(v.Value, !printable(v.Value)))
+		default:
+			b.WriteString(spellString(v.Value, v.Hex))
+		}
+	case Number:
+		switch {
+		case v.Raw != "" && !w.Normalize:
+			b.WriteString(v.Raw)
+		case v.IsInt:
+			b.WriteString(strconv.FormatInt(v.Int, 10))
+		default:
+			b.WriteString(strconv.FormatFloat(v.Float, 'f', -1, 64))
+		}
+	case Bool:
+		b.WriteString(strconv.FormatBool(v.Value))
+	case Null:
+		b.WriteString("null")
+	case Ref:
+		fmt.Fprintf(b, "%d %d R", v.Num, v.Gen)
+	case Array:
+		b.WriteByte('[')
+		for j, e := range v.Elems {
+			if j > 0 {
+				b.WriteByte(' ')
+			}
+			if err := w.object(b, e); err != nil {
+				return err
+			}
+		}
+		b.WriteByte(']')
+	case Dict:
+		b.WriteString("<<")
+		for j, e := range v.Entries {
+			if w.Normalize && hidden(v, j) {
+				continue
+			}
+			b.WriteByte(' ')
+			if err := w.object(b, e.Key); err != nil {
+				return err
+			}
+			b.WriteByte(' ')
+			if err := w.object(b, e.Value); err != nil {
+				return err
+			}
+		}
+		b.WriteString(" >>")
+	case Stream:
+		d := v.Dict
+		d.Entries = append([]DictEntry(nil), d.Entries...)
+		length := DictEntry{Name{Value: "Length"}, intNumber(len(v.Raw))}
+		found := false
+		for j, e := range d.Entries {
+			if e.Key.Value == "Length" {
+				length.Key = e.Key
+				d.Entries[j], found = length, true
+			}
+		}
+		if !found {
+			d.Entries = append(d.Entries, length)
+		}
+		if err := w.object(b, d); err != nil {
+			return err
+		}
+		b.WriteString("\nstream\n")
+		b.Write(v.Raw)
+		b.WriteString("\nendstream")
+	default:
+		return fmt.Errorf("can't write a %T", o)
+	}
+	return nil
+}
+
+// hidden reports whether entry j of d is hidden by a later entry with the
+// same key, which Dict.Get would return instead.
+func hidden(d Dict, j int) bool {
+	for _, e := range d.Entries[j+1:] {
+		if e.Key.Value == d.Entries[j].Key.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// printable reports whether a string can be written as a literal string
+// without escapes for anything but delimiters.
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
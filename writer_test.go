@@ -0,0 +1,176 @@
+package pdflex
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// spell returns the normalised spelling of o, so that objects can be
+// compared without their Spans.
+func spell(t *testing.T, o Object) string {
+	var b bytes.Buffer
+	if err := (&Writer{Normalize: true}).object(&b, o); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+// writeAll writes every object in d out with w, and opens the result.
+func writeAll(t *testing.T, d *Document, w *Writer, out *bytes.Buffer) *Document {
+	for num, r := range d.Xref {
+		if !r.Active {
+			continue
+		}
+		o, err := d.Resolve(Ref{Num: num, Gen: r.Generation})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.WriteObject(IndirectObject{Num: num, Gen: r.Generation, Value: o}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(d.Trailer); err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Open(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("rewritten file doesn't open: %s\n%s", err, out)
+	}
+	return d2
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	d, err := Open(strings.NewReader(pdf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []struct{ normalize, stream bool }{{false, false}, {true, false}, {false, true}} {
+		var out bytes.Buffer
+		w := NewWriter(&out)
+		w.Normalize, w.XrefStream = mode.normalize, mode.stream
+		d2 := writeAll(t, d, w, &out)
+
+		if !strings.HasPrefix(out.String(), "%PDF-1.7\n%\xe2\xe3\xcf\xd3\n") {
+			t.Fatalf("bad header %q", out.String()[:16])
+		}
+		if d2.Revisions[0].Stream != mode.stream {
+			t.Fatalf("wrong kind of xref, want stream %v", mode.stream)
+		}
+		if r, ok := d2.Trailer.Get("Root").(Ref); !ok || r.Num != 1 {
+			t.Fatalf("bad /Root in rewritten trailer")
+		}
+		for num, r := range d.Xref {
+			if !r.Active {
+				continue
+			}
+			ref := Ref{Num: num, Gen: r.Generation}
+			want, _ := d.Resolve(ref)
+			got, err := d2.Resolve(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spell(t, got) != spell(t, want) {
+				t.Fatalf("object %d changed\nwant %s\ngot  %s", num, spell(t, want), spell(t, got))
+			}
+		}
+		l := NewLexer("", out.String())
+		for i := l.Next(); i.Typ != ItemEOF; i = l.Next() {
+		}
+		if m := l.LengthMismatches(); len(m) > 0 {
+			t.Fatalf("stream has the wrong /Length %+v", m[0])
+		}
+	}
+}
+
+func TestWriterSpelling(t *testing.T) {
+	in := "<< /A#20B (a\\)b) /Hex <4142> /N [+5 1.50 .5] /Dup 1 /Dup 2 >>"
+	o, err := NewObjectParser(NewLexer("", in)).ParseObject()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		normalize bool
+		want      string
+	}{
+		{false, "<< /A#20B (a\\)b) /Hex <4142> /N [+5 1.50 .5] /Dup 1 /Dup 2 >>"},
+		{true, "<< /A#20B (a\\)b) /Hex (AB) /N [5 1.5 0.5] /Dup 2 >>"},
+	} {
+		var b bytes.Buffer
+		if err := (&Writer{Normalize: tt.normalize}).object(&b, o); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Fatalf("normalize %v: want %s, got %s", tt.normalize, tt.want, b.String())
+		}
+	}
+
+	// Objects built by hand have no Raw
+	d := Dict{Entries: []DictEntry{
+		{Name{Value: "a/b"}, String{Value: []byte("\x00\xff")}},
+		{Name{Value: "Hex"}, String{Value: []byte("ab"), Hex: true}},
+	}}
+	var b bytes.Buffer
+	if err := (&Writer{}).object(&b, d); err != nil {
+		t.Fatal(err)
+	}
+	if want := "<< /a#2Fb (\\000\\377) /Hex <6162> >>"; b.String() != want {
+		t.Fatalf("want %s, got %s", want, b.String())
+	}
+	if err := (&Writer{}).object(&b, Keyword{Value: "trailer"}); err == nil {
+		t.Fatalf("failed to detect unwritable object")
+	}
+}
+
+func TestWriterEncrypted(t *testing.T) {
+	for _, c := range cryptCases {
+		d, err := Open(bytes.NewReader(encryptedPDF(t, c, "", "owner")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, encrypt := range []bool{true, false} {
+			var out bytes.Buffer
+			w := NewWriter(&out)
+			if encrypt {
+				w.Crypt, w.Encrypt = d.Crypt, d.Trailer.Get("Encrypt").(Ref)
+			}
+			d2 := writeAll(t, d, w, &out)
+			if d2.Encrypted() != encrypt || (encrypt && d2.Crypt == nil) {
+				t.Fatalf("%s: want encrypted %v", c.name, encrypt)
+			}
+			if encrypt == strings.Contains(out.String(), "Secret") {
+				t.Fatalf("%s: want encrypted %v, got\n%s", c.name, encrypt, out.String())
+			}
+			checkDecrypted(t, c.name, d2)
+		}
+	}
+
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Crypt = &Crypt{}
+	if err := w.WriteTrailer(Dict{}); err == nil {
+		t.Fatalf("failed to detect missing /Encrypt")
+	}
+}
+
+func TestWriterFreeList(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	for _, num := range []int{1, 4} {
+		if err := w.WriteObject(IndirectObject{Num: num, Value: Null{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteTrailer(Dict{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"xref\n0 5\n0000000002 65535 f\r\n",
+		"0000000003 00000 f\r\n0000000000 00000 f\r\n",
+		"trailer\n<< /Size 5 >>\nstartxref\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("missing %q in\n%s", want, out.String())
+		}
+	}
+}
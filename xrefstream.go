@@ -0,0 +1,470 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"strconv"
+	"strings"
+)
+
+// Spec: 7.5.8
+// From PDF 1.5 the xref table can be replaced by a cross-reference stream,
+// which holds the same information as binary rows of three fields. /W gives
+// the width in bytes of each field, /Index gives the object numbers covered
+// as pairs of first, count (default [0 Size]). The first field is the entry
+// type:
+//   0 - free, next free object number, generation
+//   1 - in use, byte offset, generation
+//   2 - compressed, object number of the object stream, index within it
+// A zero width type field means every row is type 1. The stream is almost
+// always Flate compressed with a PNG predictor, and its dict is the trailer.
+
+// xrefStream holds the layout of an xref stream, from its dict.
+type xrefStream struct {
+	chain []filters.Filter
+	w     [3]int
+	index []int // pairs of first object number, count
+}
+
+// xrefEntry is one decoded row of an xref stream.
+type xrefEntry struct {
+	num    int
+	fields [3]int64
+}
+
+// dictInt returns the value of an integer entry in d, or def if there isn't
+// one. It reports false if the entry exists but isn't an integer.
+func dictInt(d Dict, key string, def int) (int, bool) {
+	o := d.Get(key)
+	if o == nil {
+		return def, true
+	}
+	n, ok := o.(Number)
+	if !ok || !n.IsInt {
+		return 0, false
+	}
+	return int(n.Int), true
+}
+
+// isXrefStream reports whether s is a cross-reference stream.
+func isXrefStream(s Stream) bool {
+	n, ok := s.Dict.Get("Type").(Name)
+	return ok && n.Value == "XRef"
+}
+
+// newXrefStream reads the layout of an xref stream from its dict. In the wild
+// they are all Flate compressed with a PNG predictor, but any filter chain
+// that the filters package supports will do.
+func newXrefStream(d Dict) (*xrefStream, error) {
+	x := &xrefStream{}
+
+	w, ok := d.Get("W").(Array)
+	if !ok || len(w.Elems) != 3 {
+		return nil, fmt.Errorf("xref stream /W is not an array of 3 widths")
+	}
+	for j, o := range w.Elems {
+		n, ok := o.(Number)
+		if !ok || !n.IsInt || n.Int < 0 || n.Int > 8 {
+			return nil, fmt.Errorf("xref stream has invalid /W")
+		}
+		x.w[j] = int(n.Int)
+	}
+	if x.w[1] == 0 {
+		return nil, fmt.Errorf("xref stream has zero width offset field")
+	}
+
+	size, ok := dictInt(d, "Size", -1)
+	if !ok || size < 0 {
+		return nil, fmt.Errorf("xref stream has invalid or missing /Size")
+	}
+	x.index = []int{0, size}
+	if o := d.Get("Index"); o != nil {
+		a, ok := o.(Array)
+		if !ok || len(a.Elems)%2 != 0 {
+			return nil, fmt.Errorf("xref stream has invalid /Index")
+		}
+		x.index = x.index[:0]
+		for _, o := range a.Elems {
+			n, ok := o.(Number)
+			if !ok || !n.IsInt || n.Int < 0 {
+				return nil, fmt.Errorf("xref stream has invalid /Index")
+			}
+			x.index = append(x.index, int(n.Int))
+		}
+	}
+
+	chain, err := dictFilters(d)
+	if err != nil {
+		return nil, fmt.Errorf("xref stream: %s", err)
+	}
+	x.chain = chain
+	return x, nil
+}
+
+// decode returns the rows of the xref stream body raw.
+func (x *xrefStream) decode(raw []byte) ([]xrefEntry, error) {
+	data, err := filters.Decode(raw, x.chain)
+	if err != nil {
+		return nil, err
+	}
+
+	rowLen := x.w[0] + x.w[1] + x.w[2]
+	var entries []xrefEntry
+	for j := 0; j < len(x.index); j += 2 {
+		for num := x.index[j]; num < x.index[j]+x.index[j+1]; num++ {
+			if len(data) < rowLen {
+				return nil, fmt.Errorf("xref stream is too short for its /Index")
+			}
+			e := xrefEntry{num: num, fields: [3]int64{1, 0, 0}}
+			for f, w := range x.w {
+				if w == 0 {
+					continue
+				}
+				e.fields[f] = 0
+				for _, b := range data[:w] {
+					e.fields[f] = e.fields[f]<<8 | int64(b)
+				}
+				data = data[w:]
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// encode builds a new stream body for entries, using the same layout that
+// they were decoded with.
+func (x *xrefStream) encode(entries []xrefEntry) ([]byte, error) {
+	var data []byte
+	for _, e := range entries {
+		for f, w := range x.w {
+			if w < 8 && e.fields[f]>>(8*uint(w)) != 0 {
+				return nil, fmt.Errorf("xref stream field %d too wide for object %d", f, e.num)
+			}
+			for j := w - 1; j >= 0; j-- {
+				data = append(data, byte(e.fields[f]>>(8*uint(j))))
+			}
+		}
+	}
+	return filters.Encode(data, x.chain)
+}
+
+// row converts an xref stream entry to the same Row used for xref tables.
+// It reports false for unknown entry types, which are treated as null
+// references.
+func (e xrefEntry) row() (Row, bool) {
+	switch e.fields[0] {
+	case 0:
+		return Row{Offset: int(e.fields[1]), Generation: int(e.fields[2])}, true
+	case 1:
+		return Row{Offset: int(e.fields[1]), Generation: int(e.fields[2]), Active: true}, true
+	case 2:
+		return Row{Active: true, Compressed: true, Stream: int(e.fields[1]), Index: int(e.fields[2])}, true
+	}
+	return Row{}, false
+}
+
+// xrefMark is something that matters to xref stream fixups: the start of an
+// N G obj (Typ ItemObj, Pos of N), an xref keyword, the number after a
+// startxref keyword (Typ ItemStartXref, Pos and End of the number), the
+// number after a /Prev or /XRefStm name (Typ ItemName, Key without the /) or
+// the offset of an in use xref table row (Typ ItemWord, for the n).
+type xrefMark struct {
+	Typ ItemType
+	Pos Pos
+	End Pos
+	Num int // object number, or the value of the number
+	Key string
+	Gen int // generation number, for ItemObj
+}
+
+// scanMarks lexes in, finding the xrefMarks. Stream bodies are single items
+// so their contents are never mistaken for objects.
+func scanMarks(in []byte) []xrefMark {
+	l := NewLexer("", string(in))
+	l.SetMode(Recover)
+	var marks []xrefMark
+	var sig [3]Item // the last three significant items, most recent last
+	inTable := false
+	for i := l.Next(); i.Typ != ItemEOF; i = l.Next() {
+		switch i.Typ {
+		case ItemSpace, ItemEOL, ItemComment:
+			continue
+		case ItemXref:
+			inTable = true
+		case ItemTrailer, ItemObj, ItemStartXref:
+			inTable = false
+		}
+		sig[0], sig[1], sig[2] = sig[1], sig[2], i
+		switch {
+		case inTable && i.Typ == ItemWord && i.Val == "n" && sig[0].Typ == ItemNumber && sig[1].Typ == ItemNumber:
+			if n, err := sig[0].Int(); err == nil {
+				marks = append(marks, xrefMark{Typ: ItemWord, Pos: sig[0].Pos, End: end(sig[0]), Num: int(n)})
+			}
+		case i.Typ == ItemObj && isObjNum(sig[0]) && isObjNum(sig[1]):
+			n, _ := sig[0].Int()
+			g, _ := sig[1].Int()
+			marks = append(marks, xrefMark{ItemObj, sig[0].Pos, end(i), int(n), "", int(g)})
+		case i.Typ == ItemXref:
+			marks = append(marks, xrefMark{Typ: ItemXref, Pos: i.Pos, End: end(i)})
+		case i.Typ == ItemNumber && sig[1].Typ == ItemStartXref:
+			if n, err := i.Int(); err == nil {
+				marks = append(marks, xrefMark{Typ: ItemStartXref, Pos: i.Pos, End: end(i), Num: int(n)})
+			}
+		case i.Typ == ItemNumber && sig[1].Typ == ItemName && (sig[1].Val == "/Prev" || sig[1].Val == "/XRefStm"):
+			if n, err := i.Int(); err == nil {
+				marks = append(marks, xrefMark{Typ: ItemName, Pos: i.Pos, End: end(i), Num: int(n), Key: sig[1].Val[1:]})
+			}
+		}
+	}
+	return marks
+}
+
+// xrefStreamAt parses the object at pos, reporting whether it is an xref
+// stream.
+func xrefStreamAt(in []byte, pos Pos) (Stream, bool) {
+	p := NewObjectParser(newLexerAt("", bytes.NewReader(in[pos:]), pos))
+	o, err := p.Next()
+	if err != nil {
+		return Stream{}, false
+	}
+	obj, _ := o.(IndirectObject)
+	s, ok := obj.Value.(Stream)
+	return s, ok && isXrefStream(s)
+}
+
+// replacement is new text for a span of some input.
+type replacement struct {
+	span Span
+	text []byte
+}
+
+// replaceSpans applies replacements, which must be in order and not
+// overlap, to in.
+func replaceSpans(in []byte, reps []replacement) []byte {
+	var out bytes.Buffer
+	last := Pos(0)
+	for _, r := range reps {
+		out.Write(in[last:r.span.Start])
+		out.Write(r.text)
+		last = r.span.End
+	}
+	out.Write(in[last:])
+	return out.Bytes()
+}
+
+// xrefStreamMark is an xref stream found at marks[at].
+type xrefStreamMark struct {
+	at int
+	s  Stream
+}
+
+// xrefStreams finds the marks that start xref streams.
+func xrefStreams(in []byte, marks []xrefMark) []xrefStreamMark {
+	var found []xrefStreamMark
+	for at, m := range marks {
+		if m.Typ != ItemObj {
+			continue
+		}
+		next := Pos(len(in))
+		for _, n := range marks[at+1:] {
+			if n.Typ == ItemObj || n.Typ == ItemXref {
+				next = n.Pos
+				break
+			}
+		}
+		if !bytes.Contains(in[m.Pos:next], []byte("/XRef")) {
+			continue
+		}
+		if s, ok := xrefStreamAt(in, m.Pos); ok {
+			found = append(found, xrefStreamMark{at, s})
+		}
+	}
+	return found
+}
+
+// fixXrefStreams is the xref stream counterpart of FixXrefs. It rewrites the
+// type 1 entries of every xref stream in in to point to the last definition
+// of each object, with the same generation, before the stream, and fixes the
+// startxref after it. Type 0 and 2 entries are kept as they are, so object
+// streams have to be left alone. Streams that can't be decoded, or whose /W
+// is too narrow for the new offsets, are not modified. Finally the /Prev and
+// /XRefStm pointers of every section are fixed.
+//
+// The streams are fixed front to back, from a single scan of in. A stream
+// that changes size moves everything after it, so the marks and every offset
+// that points past it are shifted to match before the next one is fixed.
+func fixXrefStreams(in []byte) []byte {
+	in = append([]byte(nil), in...)
+	marks := scanMarks(in)
+	streams := xrefStreams(in, marks)
+	for _, x := range streams {
+		// Spans have to be read again, earlier fixes may have moved it
+		if s, ok := xrefStreamAt(in, marks[x.at].Pos); ok {
+			in = fixXrefStream(in, marks, x.at, s)
+		}
+	}
+	return fixPointers(in, marks, streams)
+}
+
+// setNumber rewrites the number at marks[j] as n. Table rows keep their ten
+// digits, and other numbers are padded with spaces to their old width so
+// that nothing else moves. A number that is wider than before moves
+// everything after it, which is shifted to match.
+func setNumber(in []byte, marks []xrefMark, j, n int) []byte {
+	m := &marks[j]
+	text := strconv.Itoa(n)
+	if m.Typ == ItemWord {
+		text = fmt.Sprintf("%.10d", n)
+	}
+	width := int(m.End - m.Pos)
+	m.Num = n
+	if len(text) <= width {
+		text += strings.Repeat(" ", width-len(text))
+		copy(in[m.Pos:m.End], text)
+		return in
+	}
+	end := m.End
+	in = replaceSpans(in, []replacement{{Span{m.Pos, end}, []byte(text)}})
+	m.End = m.Pos + Pos(len(text))
+	return shift(in, marks, end, len(text)-width)
+}
+
+// shift fixes up after an edit that ended at from, in the old positions, and
+// changed the length of in by delta. Marks after the edit are moved, and the
+// startxref, /Prev, /XRefStm and xref table offsets that point past it are
+// rewritten.
+func shift(in []byte, marks []xrefMark, from Pos, delta int) []byte {
+	if delta == 0 {
+		return in
+	}
+	var moved []int
+	for j := range marks {
+		m := &marks[j]
+		if m.Pos >= from {
+			m.Pos += Pos(delta)
+			m.End += Pos(delta)
+		}
+		switch m.Typ {
+		case ItemStartXref, ItemName, ItemWord:
+			if m.Num >= int(from) {
+				m.Num += delta
+				moved = append(moved, j)
+			}
+		}
+	}
+	// All the marks are up to date before any text is rewritten, which can
+	// shift them again
+	for _, j := range moved {
+		in = setNumber(in, marks, j, marks[j].Num)
+	}
+	return in
+}
+
+// Where a /Prev or /XRefStm was found, for fixPointers.
+const (
+	inObject = iota
+	inTable
+	inStream
+)
+
+// fixPointers points each /Prev at the xref section before the one it
+// belongs to, and each /XRefStm at the last xref stream before its trailer.
+// In hybrid files the xref streams aren't part of the /Prev chain, so a
+// trailer's /Prev only ever points at an xref table. The first section has
+// nothing before it, so the forward /Prev in the first page trailer of a
+// linearized file is left alone. New values are written with setNumber.
+func fixPointers(in []byte, marks []xrefMark, streams []xrefStreamMark) []byte {
+	isStream := make(map[int]bool)
+	for _, x := range streams {
+		isStream[x.at] = true
+	}
+	where := inObject
+	lastTable, lastStream := -1, -1
+	prevTable, prevSection := -1, -1
+	for at, m := range marks {
+		switch {
+		case m.Typ == ItemXref:
+			prevTable, lastTable = lastTable, int(m.Pos)
+			where = inTable
+		case m.Typ == ItemObj && isStream[at]:
+			prevSection = lastTable
+			if lastStream > prevSection {
+				prevSection = lastStream
+			}
+			lastStream = int(m.Pos)
+			where = inStream
+		case m.Typ == ItemObj:
+			where = inObject
+		case m.Typ == ItemName:
+			want := -1
+			switch {
+			case m.Key == "Prev" && where == inTable:
+				want = prevTable
+			case m.Key == "Prev" && where == inStream:
+				want = prevSection
+			case m.Key == "XRefStm" && where == inTable:
+				want = lastStream
+			}
+			if want >= 0 && want != m.Num {
+				in = setNumber(in, marks, at, want)
+			}
+		}
+	}
+	return in
+}
+
+// fixXrefStream fixes the xref stream s, which starts at marks[at], and the
+// startxref after it. marks are kept up to date with any change in size.
+func fixXrefStream(in []byte, marks []xrefMark, at int, s Stream) []byte {
+	// The last definition with the right generation wins
+	where := make(map[[2]int]Pos)
+	for _, m := range marks[:at+1] {
+		if m.Typ == ItemObj {
+			where[[2]int{m.Num, m.Gen}] = m.Pos
+		}
+	}
+	x, err := newXrefStream(s.Dict)
+	var entries []xrefEntry
+	if err == nil {
+		entries, err = x.decode(s.Raw)
+	}
+	changed := false
+	for j, e := range entries {
+		if e.fields[0] != 1 {
+			continue
+		}
+		if p, ok := where[[2]int{e.num, int(e.fields[2])}]; ok && e.fields[1] != int64(p) {
+			entries[j].fields[1] = int64(p)
+			changed = true
+		}
+	}
+	length, ok := s.Dict.Get("Length").(Number)
+	if changed && ok {
+		if body, err := x.encode(entries); err == nil {
+			// The body first, so the /Length span is still right
+			in = replaceSpans(in, []replacement{{s.Body, body}})
+			in = shift(in, marks, s.Body.End, len(body)-len(s.Raw))
+			l := strconv.Itoa(len(body))
+			in = replaceSpans(in, []replacement{{length.Span(), []byte(l)}})
+			in = shift(in, marks, length.Span().End, len(l)-len(length.Raw))
+		}
+	}
+
+	// The startxref directly after this stream should point to it
+	pos := marks[at].Pos
+	for j := at + 1; j < len(marks); j++ {
+		m := marks[j]
+		if m.Typ == ItemObj || m.Typ == ItemXref {
+			break
+		}
+		if m.Typ == ItemStartXref {
+			if m.Num != int(pos) {
+				in = setNumber(in, marks, j, int(pos))
+			}
+			break
+		}
+	}
+	return in
+}
@@ -0,0 +1,275 @@
+package pdflex
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bnagy/pdflex/filters"
+	"strings"
+	"testing"
+)
+
+// xrefStreamPDF builds a PDF 1.5 file whose xref is a Flate compressed, PNG
+// predicted stream. Object 3 is a stream with the given body, object 4 is
+// compressed into (nonexistent) object stream 6 and object 5 is the xref
+// stream itself.
+func xrefStreamPDF(t *testing.T, body string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.5\n")
+	offs := make(map[int]int)
+	add := func(num int, s string) {
+		offs[num] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", num, s)
+	}
+	add(1, "<< /Type /Catalog /Pages 2 0 R >>")
+	add(2, "<< /Type /Pages /Kids [] /Count 0 >>")
+	add(3, fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(body), body))
+	offs[5] = b.Len()
+
+	x := &xrefStream{
+		chain: []filters.Filter{{
+			Name:   "FlateDecode",
+			Params: filters.Params{"Predictor": 12, "Columns": 4},
+		}},
+		w:     [3]int{1, 2, 1},
+		index: []int{0, 6},
+	}
+	entries := []xrefEntry{
+		{0, [3]int64{0, 0, 255}},
+		{1, [3]int64{1, int64(offs[1]), 0}},
+		{2, [3]int64{1, int64(offs[2]), 0}},
+		{3, [3]int64{1, int64(offs[3]), 0}},
+		{4, [3]int64{2, 6, 0}},
+		{5, [3]int64{1, int64(offs[5]), 0}},
+	}
+	data, err := x.encode(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&b,
+		"5 0 obj\n<< /Type /XRef /Size 6 /W [1 2 1] /Root 1 0 R /Filter /FlateDecode "+
+			"/DecodeParms << /Columns 4 /Predictor 12 >> /Length %d >>\nstream\n%s\nendstream\nendobj\n",
+		len(data), data,
+	)
+	fmt.Fprintf(&b, "startxref\n%d\n%%%%EOF\n", offs[5])
+	return b.Bytes()
+}
+
+func TestXrefStream(t *testing.T) {
+	body := strings.Repeat("A", 200)
+	in := xrefStreamPDF(t, body)
+	d, err := Open(bytes.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Xref) != 6 {
+		t.Fatalf("want 6 xref entries, got %d", len(d.Xref))
+	}
+	if r := d.Xref[0]; r.Active || r.Generation != 255 {
+		t.Fatalf("bad free entry %#v", r)
+	}
+	if r := d.Xref[4]; !r.Active || !r.Compressed || r.Stream != 6 || r.Index != 0 {
+		t.Fatalf("bad compressed entry %#v", r)
+	}
+	if r := d.Xref[5]; !r.Active || r.Offset != d.StartXref {
+		t.Fatalf("bad entry for the xref stream %#v", r)
+	}
+	if d.Trailer.Get("Root").(Ref).Num != 1 {
+		t.Fatalf("bad trailer %#v", d.Trailer)
+	}
+
+	o, err := d.Resolve(Ref{Num: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(o.(Stream).Raw) != body {
+		t.Fatalf("bad stream body %q", o.(Stream).Raw)
+	}
+	if _, err := d.Resolve(Ref{Num: 4}); err == nil {
+		t.Fatalf("resolved an object in a missing object stream")
+	}
+}
+
+func TestXrefStreamErrors(t *testing.T) {
+	in := string(xrefStreamPDF(t, "x"))
+	for _, r := range []struct{ old, new string }{
+		{"/W [1 2 1]", "/W [1 2]"},
+		{"/W [1 2 1]", "/W [1 0 3]"},
+		{"/Size 6", "/Size 7"},
+		{"/Size 6", "/Size /Six"},
+		{"/FlateDecode", "/LZWDecode"},
+		{"/Predictor 12", "/Predictor 2"},
+		{"/Type /XRef", "/Type /XRefs"},
+	} {
+		bad := strings.Replace(in, r.old, r.new, 1)
+		if _, err := Open(strings.NewReader(bad)); err == nil {
+			t.Fatalf("failed to detect error with %s", r.new)
+		}
+	}
+}
+
+func TestFixXrefStream(t *testing.T) {
+	in := xrefStreamPDF(t, strings.Repeat("A", 200))
+	// pdfshrink style truncation, leaving every offset after it wrong
+	shrunk := bytes.Replace(in, []byte(strings.Repeat("A", 200)), []byte("AAAA"), 1)
+	shrunk = bytes.Replace(shrunk, []byte("/Length 200"), []byte("/Length 4"), 1)
+
+	fixed := fix(t, shrunk)
+	d, err := Open(bytes.NewReader(fixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Index(fixed, []byte("5 0 obj")); d.StartXref != want || d.Xref[5].Offset != want {
+		t.Fatalf("want xref stream at %d, got startxref %d, row %#v", want, d.StartXref, d.Xref[5])
+	}
+	if r := d.Xref[4]; !r.Compressed || r.Stream != 6 {
+		t.Fatalf("compressed entry was modified %#v", r)
+	}
+	for num := 1; num <= 3; num++ {
+		if _, err := d.Resolve(Ref{Num: num}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFixXrefStreamUnmodified(t *testing.T) {
+	in := xrefStreamPDF(t, strings.Repeat("A", 200))
+	if fixed := fix(t, in); !bytes.Equal(fixed, in) {
+		t.Fatalf("clean xref stream was modified by fix")
+	}
+}
+
+func TestFixPrev(t *testing.T) {
+	// Shrink a stream in the first revision, which moves every later section
+	shrunk := strings.Replace(update(pdf), "    (Hello World) Tj\n", "", 1)
+	fixed := fix(t, []byte(shrunk))
+	d, err := Open(bytes.NewReader(fixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Revisions) != 2 {
+		t.Fatalf("want 2 revisions, got %d", len(d.Revisions))
+	}
+	if want := bytes.Index(fixed, []byte("xref\n0 5")); d.Revisions[0].Offset != want {
+		t.Fatalf("want first xref at %d, got %d", want, d.Revisions[0].Offset)
+	}
+	if len(fixed) != len(shrunk) {
+		t.Fatalf("fixing /Prev changed the file size")
+	}
+}
+
+func TestFixPrevStream(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(xrefStreamPDF(t, strings.Repeat("A", 200)))
+	prev := bytes.Index(b.Bytes(), []byte("5 0 obj"))
+	seven := b.Len()
+	b.WriteString("7 0 obj\n(seven)\nendobj\n")
+	eight := b.Len()
+	x := &xrefStream{w: [3]int{1, 2, 1}, index: []int{7, 2}}
+	data, err := x.encode([]xrefEntry{
+		{7, [3]int64{1, int64(seven), 0}},
+		{8, [3]int64{1, int64(eight), 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&b, "8 0 obj\n<< /Type /XRef /Size 9 /Index [7 2] /W [1 2 1] /Root 1 0 R /Prev %d /Length %d >>\n"+
+		"stream\n%s\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", prev, len(data), data, eight)
+
+	shrunk := bytes.Replace(b.Bytes(), []byte(strings.Repeat("A", 200)), []byte("AAAA"), 1)
+	shrunk = bytes.Replace(shrunk, []byte("/Length 200"), []byte("/Length 4"), 1)
+	fixed := fix(t, shrunk)
+	d, err := Open(bytes.NewReader(fixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Revisions) != 2 || !d.Revisions[0].Stream || !d.Revisions[1].Stream {
+		t.Fatalf("want 2 xref stream revisions, got %#v", d.Revisions)
+	}
+	if want := bytes.Index(fixed, []byte("5 0 obj")); d.Revisions[0].Offset != want {
+		t.Fatalf("want first xref stream at %d, got %d", want, d.Revisions[0].Offset)
+	}
+	for _, num := range []int{1, 3, 7} {
+		if _, err := d.Resolve(Ref{Num: num}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFixXrefStreamMovesLaterSections(t *testing.T) {
+	// Garbage offsets compress worse than the right ones, so fixing them
+	// shrinks the xref stream and moves the table revision after it
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.5\n")
+	x := &xrefStream{chain: []filters.Filter{{Name: "FlateDecode"}}, w: [3]int{1, 4, 1}, index: []int{0, 42}}
+	entries := []xrefEntry{{0, [3]int64{0, 0, 255}}}
+	for num := 1; num <= 40; num++ {
+		fmt.Fprintf(&b, "%d 0 obj\n<< /Type /Catalog >>\nendobj\n", num)
+		entries = append(entries, xrefEntry{num, [3]int64{1, int64(num) * 7919 * 104729 % 1e9, 0}})
+	}
+	prev := b.Len()
+	entries = append(entries, xrefEntry{41, [3]int64{1, int64(prev), 0}})
+	data, err := x.encode(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&b, "41 0 obj\n<< /Type /XRef /Size 42 /W [1 4 1] /Root 1 0 R /Filter /FlateDecode /Length %d >>\n"+
+		"stream\n%s\nendstream\nendobj\nstartxref\n%d\n%%%%EOF\n", len(data), data, prev)
+	seven := b.Len()
+	b.WriteString("42 0 obj\n(seven)\nendobj\n")
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 1\n0000000000 65535 f \n42 1\n%.10d 00000 n \n"+
+		"trailer\n<< /Size 43 /Root 1 0 R /Prev %d >>\nstartxref\n%d\n%%%%EOF\n", seven, prev, xref)
+
+	fixed := fix(t, b.Bytes())
+	if len(fixed) == b.Len() {
+		t.Fatalf("xref stream didn't change size, so nothing was tested")
+	}
+	d, err := Open(bytes.NewReader(fixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := bytes.Index(fixed, []byte("xref\n0 1")); d.StartXref != want {
+		t.Fatalf("want startxref %d, got %d", want, d.StartXref)
+	}
+	if len(d.Revisions) != 2 || !d.Revisions[0].Stream || d.Revisions[0].Offset != prev {
+		t.Fatalf("want an xref stream at %d and a table, got %#v", prev, d.Revisions)
+	}
+	for _, num := range []int{1, 40} {
+		if o, err := d.Resolve(Ref{Num: num}); err != nil || !hasType(o, "Catalog") {
+			t.Fatalf("bad object %d %#v %v", num, o, err)
+		}
+	}
+	o, err := d.Resolve(Ref{Num: 42})
+	if err != nil || string(o.(String).Value) != "seven" {
+		t.Fatalf("bad object 42 %#v %v", o, err)
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	// A table that marks object 4 free, with an /XRefStm that has it
+	// compressed, and object 3 in use
+	in := xrefStreamPDF(t, "x")
+	stm := bytes.Index(in, []byte("5 0 obj"))
+	var b bytes.Buffer
+	b.Write(in[:bytes.LastIndex(in, []byte("startxref"))])
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 1\n0000000000 65535 f \n4 1\n0000000000 00001 f \n"+
+		"trailer\n<< /Size 6 /Root 1 0 R /XRefStm %d >>\nstartxref\n%d\n%%%%EOF\n", stm, xref)
+
+	d, err := Open(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Revisions) != 1 || d.Revisions[0].Stream {
+		t.Fatalf("want 1 xref table revision, got %#v", d.Revisions)
+	}
+	if r := d.Xref[4]; !r.Compressed {
+		t.Fatalf("/XRefStm entry didn't override free entry %#v", r)
+	}
+	if r := d.Xref[3]; !r.Active {
+		t.Fatalf("/XRefStm entry missing %#v", r)
+	}
+	if r := d.Xref[0]; r.Active || r.Generation != 65535 {
+		t.Fatalf("table entry was overridden %#v", r)
+	}
+}